@@ -0,0 +1,341 @@
+package rombo
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bodgit/rombo/internal/plumbing"
+	"github.com/bodgit/sevenzip"
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// archiveFile is a single member of an archive
+type archiveFile interface {
+	Name() string
+	Size() uint64
+	CRC() string
+	Open() (io.ReadCloser, error)
+}
+
+// archiveReader provides access to the members of an archive
+type archiveReader interface {
+	Format() string
+	Files() []archiveFile
+}
+
+func isArchive(ext string) bool {
+	switch ext {
+	case ".zip", ".7z", ".rar", ".tar", ".gz":
+		return true
+	default:
+		return false
+	}
+}
+
+type zipFile struct {
+	f *zip.File
+}
+
+func (z zipFile) Name() string {
+	return z.f.Name
+}
+
+func (z zipFile) Size() uint64 {
+	return z.f.UncompressedSize64
+}
+
+func (z zipFile) CRC() string {
+	return zipCRC(z.f)
+}
+
+func (z zipFile) Open() (io.ReadCloser, error) {
+	return z.f.Open()
+}
+
+type zipReader struct {
+	r *zip.Reader
+}
+
+func (zipReader) Format() string {
+	return ".zip"
+}
+
+func (z zipReader) Files() []archiveFile {
+	files := make([]archiveFile, 0, len(z.r.File))
+	for _, f := range z.r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		files = append(files, zipFile{f})
+	}
+	return files
+}
+
+type sevenZipFile struct {
+	f *sevenzip.File
+}
+
+func (s sevenZipFile) Name() string {
+	return s.f.Name
+}
+
+func (s sevenZipFile) Size() uint64 {
+	return s.f.UncompressedSize
+}
+
+func (s sevenZipFile) CRC() string {
+	return fmt.Sprintf("%.*x", crc32.Size<<1, s.f.CRC32)
+}
+
+func (s sevenZipFile) Open() (io.ReadCloser, error) {
+	return s.f.Open()
+}
+
+type sevenZipReader struct {
+	r *sevenzip.Reader
+}
+
+func (sevenZipReader) Format() string {
+	return ".7z"
+}
+
+func (s sevenZipReader) Files() []archiveFile {
+	files := make([]archiveFile, 0, len(s.r.File))
+	for _, f := range s.r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		files = append(files, sevenZipFile{f})
+	}
+	return files
+}
+
+// newArchiveReader returns an archiveReader for the archive called name of
+// the given format, identified by its usual file extension, read from r
+func newArchiveReader(name, ext string, r io.ReaderAt, size int64) (archiveReader, error) {
+	switch ext {
+	case ".zip":
+		reader, err := zip.NewReader(r, size)
+		if err != nil {
+			return nil, err
+		}
+		return zipReader{reader}, nil
+	case ".7z":
+		reader, err := sevenzip.NewReader(r, size)
+		if err != nil {
+			return nil, err
+		}
+		return sevenZipReader{reader}, nil
+	case ".rar":
+		return newRARReader(r, size)
+	case ".tar":
+		return newTarReader(r, size)
+	case ".gz":
+		return newGzipReader(name, r, size)
+	default:
+		return nil, fmt.Errorf("unsupported archive format: %s", ext)
+	}
+}
+
+// scanArchive checksums every member of a sequential archive, it does
+// nothing for any other format
+func scanArchive(reader archiveReader, cache *memberCache) error {
+	if s, ok := reader.(*streamReader); ok {
+		return s.scan(cache)
+	}
+	return nil
+}
+
+// readArchive opens the archive file, detecting the format from its
+// contents, without scanning any sequential archive
+func readArchive(file string) (archiveReader, *os.File, os.FileInfo, error) {
+	mime, err := mimetype.DetectFile(file)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, nil, err
+	}
+
+	reader, err := newArchiveReader(file, mime.Extension(), f, info.Size())
+	if err != nil {
+		f.Close()
+		return nil, nil, nil, err
+	}
+
+	return reader, f, info, nil
+}
+
+// openArchive opens the archive file, detecting the format from its
+// contents. The cache, if there is one, saves checksumming the members of
+// sequential archives again
+func openArchive(file string, cache *Cache) (archiveReader, io.Closer, error) {
+	reader, f, info, err := readArchive(file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := scanArchive(reader, newMemberCache(cache, file, info)); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	return reader, f, nil
+}
+
+// memberPath is the chain of member names leading to a file within an
+// archive, outermost first
+type memberPath []string
+
+func (p memberPath) String() string {
+	return strings.Join(p, "/")
+}
+
+// readNestedArchive reads the member f into memory and opens it as an
+// archive without scanning it, returning nil if it isn't one
+func readNestedArchive(f archiveFile) (archiveReader, error) {
+	if !isArchive(strings.ToLower(filepath.Ext(f.Name()))) {
+		return nil, nil
+	}
+
+	fr, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer fr.Close()
+
+	b, err := ioutil.ReadAll(fr)
+	if err != nil {
+		return nil, err
+	}
+
+	mime := mimetype.Detect(b)
+	if !isArchive(mime.Extension()) {
+		return nil, nil
+	}
+
+	return newArchiveReader(f.Name(), mime.Extension(), bytes.NewReader(b), int64(len(b)))
+}
+
+// openNestedArchive is like readNestedArchive but also scans any
+// sequential archive
+func openNestedArchive(f archiveFile) (archiveReader, error) {
+	reader, err := readNestedArchive(f)
+	if err != nil || reader == nil {
+		return nil, err
+	}
+
+	if err := scanArchive(reader, nil); err != nil {
+		return nil, err
+	}
+
+	return reader, nil
+}
+
+// walkArchive calls fn for every member of the archive, descending into
+// any archives within it up to depth levels deep
+func walkArchive(reader archiveReader, depth int, fn func(memberPath, archiveFile) error) error {
+	return walkNestedArchive(reader, nil, depth, fn)
+}
+
+func walkNestedArchive(reader archiveReader, parent memberPath, depth int, fn func(memberPath, archiveFile) error) error {
+	for _, f := range reader.Files() {
+		path := append(parent[:len(parent):len(parent)], f.Name())
+
+		// The member itself could match, even if it's an archive
+		if err := fn(path, f); err != nil {
+			return err
+		}
+
+		if depth <= 0 {
+			continue
+		}
+
+		// Anything that isn't really an archive is already skipped so
+		// any error is a corrupt or unsupported nested archive
+		nested, err := openNestedArchive(f)
+		if err != nil {
+			return fmt.Errorf("nested archive %s: %v", path, err)
+		}
+
+		if nested != nil {
+			if err := walkNestedArchive(nested, path, depth-1, fn); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// findMember returns the member of the archive called name, or nil if
+// there isn't one. Sequential archives aren't scanned first, instead the
+// member is found when it's opened
+func findMember(reader archiveReader, name string) archiveFile {
+	if s, ok := reader.(*streamReader); ok {
+		return s.member(name)
+	}
+
+	for _, f := range reader.Files() {
+		if f.Name() == name {
+			return f
+		}
+	}
+
+	return nil
+}
+
+// openArchiveFile opens the member at path within the archive file,
+// descending into any nested archives
+func openArchiveFile(file string, path memberPath) (io.ReadCloser, error) {
+	reader, closer, _, err := readArchive(file)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, name := range path {
+		member := findMember(reader, name)
+		if member == nil {
+			closer.Close()
+			return nil, fmt.Errorf("no member %s in %s", path, file)
+		}
+
+		if i == len(path)-1 {
+			fr, err := member.Open()
+			if err != nil {
+				closer.Close()
+				return nil, err
+			}
+			return plumbing.MultiReadCloser(fr, fr, closer), nil
+		}
+
+		nested, err := readNestedArchive(member)
+		if err == nil && nested == nil {
+			err = fmt.Errorf("%s in %s is not an archive", member.Name(), file)
+		}
+		if err != nil {
+			closer.Close()
+			return nil, err
+		}
+		reader = nested
+	}
+
+	closer.Close()
+
+	return nil, fmt.Errorf("no member %s in %s", path, file)
+}
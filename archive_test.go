@@ -0,0 +1,207 @@
+package rombo
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// archiveCRCs returns the CRC of the contents of every member of the
+// archive, checking each one against the size and CRC the archive reports
+func archiveCRCs(t *testing.T, reader archiveReader) map[string]string {
+	t.Helper()
+
+	crcs := make(map[string]string)
+	for _, f := range reader.Files() {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if f.Size() != uint64(len(b)) || f.CRC() != fmt.Sprintf("%08x", crc32.ChecksumIEEE(b)) {
+			t.Errorf("%s has size %d and CRC %s, want %d and %08x", f.Name(), f.Size(), f.CRC(), len(b), crc32.ChecksumIEEE(b))
+		}
+
+		crcs[f.Name()] = fmt.Sprintf("%08x", crc32.ChecksumIEEE(b))
+	}
+
+	return crcs
+}
+
+func readArchiveFile(t *testing.T, file string, path memberPath) string {
+	t.Helper()
+
+	rc, err := openArchiveFile(file, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(b)
+}
+
+func TestOpenArchive(t *testing.T) {
+	tests := []struct {
+		file   string
+		format string
+		crcs   map[string]string
+	}{
+		// From the testdata of github.com/bodgit/sevenzip
+		{"testdata/sevenzip.7z", ".7z", map[string]string{"foo": "7e3265a8", "bar": "04a2b3e9"}},
+		// From the testdata of github.com/gabriel-vasile/mimetype
+		{"testdata/rar.rar", ".rar", map[string]string{"asd.go": "230ceab5"}},
+		{"testdata/tar.tar", ".tar", map[string]string{"a.rom": "c74ab32a", "dir/b.rom": "060fc07e"}},
+		{"testdata/tar.tar.gz", ".tar.gz", map[string]string{"a.rom": "c74ab32a", "dir/b.rom": "060fc07e"}},
+		{"testdata/single.rom.gz", ".gz", map[string]string{"single.rom": "56760974"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			reader, closer, err := openArchive(tt.file, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closer.Close()
+
+			if reader.Format() != tt.format {
+				t.Errorf("got format %s, want %s", reader.Format(), tt.format)
+			}
+
+			if got := archiveCRCs(t, reader); !reflect.DeepEqual(got, tt.crcs) {
+				t.Errorf("got %v, want %v", got, tt.crcs)
+			}
+
+			// Each member can also be opened directly by name
+			for name, want := range tt.crcs {
+				if got := fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(readArchiveFile(t, tt.file, memberPath{name})))); got != want {
+					t.Errorf("got CRC %s for %s, want %s", got, name, want)
+				}
+			}
+		})
+	}
+}
+
+func TestGzipMemberName(t *testing.T) {
+	tests := []struct {
+		file string
+		want string
+	}{
+		{"single.rom.gz", "single.rom"},
+		{"SINGLE.ROM.GZ", "SINGLE.ROM"},
+		{"single.rom", "single.rom"},
+	}
+
+	b, err := ioutil.ReadFile("testdata/single.rom.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), tt.file)
+			if err := ioutil.WriteFile(file, b, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			reader, closer, err := openArchive(file, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closer.Close()
+
+			if got := archiveCRCs(t, reader); !reflect.DeepEqual(got, map[string]string{tt.want: "56760974"}) {
+				t.Errorf("got %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWalkArchiveCorrupt(t *testing.T) {
+	reader, closer, err := openArchive("testdata/corrupt.zip", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+
+	// Without descending the corrupt archive is just another member
+	if err := walkArchive(reader, 0, func(memberPath, archiveFile) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := walkArchive(reader, 1, func(memberPath, archiveFile) error { return nil }); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestWalkArchiveDepth(t *testing.T) {
+	tests := []struct {
+		depth int
+		paths []string
+	}{
+		{0, []string{"a.rom", "inner.zip"}},
+		{1, []string{"a.rom", "inner.zip", "inner.zip/c.rom", "inner.zip/inner.tar.gz"}},
+		{2, []string{"a.rom", "inner.zip", "inner.zip/c.rom", "inner.zip/inner.tar.gz", "inner.zip/inner.tar.gz/d.rom"}},
+		{3, []string{"a.rom", "inner.zip", "inner.zip/c.rom", "inner.zip/inner.tar.gz", "inner.zip/inner.tar.gz/d.rom"}},
+	}
+
+	reader, closer, err := openArchive("testdata/nested.zip", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.depth), func(t *testing.T) {
+			var paths []string
+			err := walkArchive(reader, tt.depth, func(path memberPath, f archiveFile) error {
+				paths = append(paths, path.String())
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(paths, tt.paths) {
+				t.Errorf("got %v, want %v", paths, tt.paths)
+			}
+		})
+	}
+}
+
+func TestOpenNestedArchiveFile(t *testing.T) {
+	tests := []struct {
+		path memberPath
+		want string
+	}{
+		{memberPath{"a.rom"}, "first\n"},
+		{memberPath{"inner.zip", "c.rom"}, "third\n"},
+		{memberPath{"inner.zip", "inner.tar.gz", "d.rom"}, "fourth\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path.String(), func(t *testing.T) {
+			if got := readArchiveFile(t, "testdata/nested.zip", tt.path); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	for _, path := range []memberPath{{"missing.rom"}, {"inner.zip", "missing.rom"}, {"a.rom", "c.rom"}} {
+		if _, err := openArchiveFile("testdata/nested.zip", path); err == nil {
+			t.Errorf("expected an error opening %s", path)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package rombo
+
+import (
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type cacheKey struct {
+	Path   string
+	Member string
+}
+
+type cacheEntry struct {
+	FileSize int64
+	ModTime  int64
+	Inode    uint64
+	Size     uint64
+	CRC      string
+	MD5      string
+	SHA1     string
+	Disk     bool
+}
+
+// Cache is a persistent store of file and archive member checksums. An
+// entry is only used if the size, modification time and inode of the file
+// on disk are unchanged since it was recorded
+type Cache struct {
+	file    string
+	entries map[cacheKey]cacheEntry
+	dirty   bool
+	mutex   sync.Mutex
+}
+
+// NewCache returns a Cache backed by file, which is read if it exists
+func NewCache(file string) (*Cache, error) {
+	c := Cache{
+		file:    file,
+		entries: make(map[cacheKey]cacheEntry),
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &c, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := gob.NewDecoder(f).Decode(&c.entries); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// Save writes the cache back to disk if it has been modified
+func (c *Cache) Save() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.dirty {
+		return nil
+	}
+
+	dir := filepath.Dir(c.file)
+	if err := os.MkdirAll(dir, os.FileMode(0777)); err != nil {
+		return err
+	}
+
+	tmpfile, err := ioutil.TempFile(dir, "."+filepath.Base(c.file))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if err := gob.NewEncoder(tmpfile).Encode(c.entries); err != nil {
+		tmpfile.Close()
+		return err
+	}
+
+	if err := tmpfile.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpfile.Name(), c.file); err != nil {
+		return err
+	}
+
+	c.dirty = false
+
+	return nil
+}
+
+// isCacheFile reports whether file is where the cache is saved, so it's not
+// treated as a ROM, or deleted by Clean, when kept in a target directory
+func (c *Cache) isCacheFile(file string) bool {
+	a, err := filepath.Abs(file)
+	if err != nil {
+		return false
+	}
+	b, err := filepath.Abs(c.file)
+	if err != nil {
+		return false
+	}
+	return a == b
+}
+
+func newCacheKey(path, member string) cacheKey {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return cacheKey{path, member}
+}
+
+func (c *Cache) lookup(path, member string, info os.FileInfo) (checksum, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// For archive members the file is the archive itself
+	entry, ok := c.entries[newCacheKey(path, member)]
+	if !ok || entry.FileSize != info.Size() || entry.ModTime != info.ModTime().UnixNano() || entry.Inode != inode(info) {
+		return checksum{}, false
+	}
+
+	return checksum{
+		size: entry.Size,
+		crc:  entry.CRC,
+		md5:  entry.MD5,
+		sha1: entry.SHA1,
+		disk: entry.Disk,
+	}, true
+}
+
+func (c *Cache) store(path, member string, info os.FileInfo, sum checksum) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.entries[newCacheKey(path, member)] = cacheEntry{
+		FileSize: info.Size(),
+		ModTime:  info.ModTime().UnixNano(),
+		Inode:    inode(info),
+		Size:     sum.size,
+		CRC:      sum.crc,
+		MD5:      sum.md5,
+		SHA1:     sum.sha1,
+		Disk:     sum.disk,
+	}
+	c.dirty = true
+}
+
+// memberCache is the cache for the members of a single archive file, a nil
+// memberCache never finds anything
+type memberCache struct {
+	cache *Cache
+	file  string
+	info  os.FileInfo
+}
+
+func newMemberCache(cache *Cache, file string, info os.FileInfo) *memberCache {
+	if cache == nil {
+		return nil
+	}
+	return &memberCache{cache, file, info}
+}
+
+func (c *memberCache) lookup(member string) (checksum, bool) {
+	if c == nil {
+		return checksum{}, false
+	}
+	return c.cache.lookup(c.file, member, c.info)
+}
+
+func (c *memberCache) store(member string, sum checksum) {
+	if c == nil {
+		return
+	}
+	c.cache.store(c.file, member, c.info, sum)
+}
@@ -0,0 +1,211 @@
+package rombo
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "cache")
+	rom := filepath.Join(dir, "a.rom")
+
+	if err := ioutil.WriteFile(rom, []byte("rom"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stat := func() os.FileInfo {
+		t.Helper()
+		info, err := os.Stat(rom)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+
+	c, err := NewCache(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := checksum{size: 3, crc: "00000001", md5: "md5", sha1: "sha1"}
+	disk := checksum{sha1: "sha1", disk: true}
+	c.store(rom, "", stat(), want)
+	c.store(rom, "member", stat(), disk)
+
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(*testing.T)
+		hit    bool
+	}{
+		{
+			"unchanged",
+			func(*testing.T) {},
+			true,
+		},
+		{
+			"mtime",
+			func(t *testing.T) {
+				if err := os.Chtimes(rom, time.Now(), stat().ModTime().Add(time.Second)); err != nil {
+					t.Fatal(err)
+				}
+			},
+			false,
+		},
+		{
+			"size",
+			func(t *testing.T) {
+				mtime := stat().ModTime()
+				if err := ioutil.WriteFile(rom, []byte("rom!"), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(rom, mtime, mtime); err != nil {
+					t.Fatal(err)
+				}
+			},
+			false,
+		},
+		{
+			"inode",
+			func(t *testing.T) {
+				if inode(stat()) == 0 {
+					t.Skip("no inode numbers")
+				}
+				// Same size and modification time but a new file
+				mtime := stat().ModTime()
+				tmp := filepath.Join(dir, "b.rom")
+				if err := ioutil.WriteFile(tmp, []byte("ROM"), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(tmp, mtime, mtime); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Rename(tmp, rom); err != nil {
+					t.Fatal(err)
+				}
+			},
+			false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ioutil.WriteFile(rom, []byte("rom"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			info := stat()
+
+			c, err := NewCache(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.store(rom, "", info, want)
+			c.store(rom, "member", info, disk)
+			if err := c.Save(); err != nil {
+				t.Fatal(err)
+			}
+
+			tt.change(t)
+
+			c, err = NewCache(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sum, ok := c.lookup(rom, "", stat())
+			if ok != tt.hit {
+				t.Fatalf("got hit %v, want %v", ok, tt.hit)
+			}
+			if ok && sum != want {
+				t.Errorf("got %+v, want %+v", sum, want)
+			}
+
+			sum, ok = c.lookup(rom, "member", stat())
+			if ok != tt.hit {
+				t.Fatalf("got member hit %v, want %v", ok, tt.hit)
+			}
+			if ok && sum != disk {
+				t.Errorf("got member %+v, want %+v", sum, disk)
+			}
+		})
+	}
+}
+
+func TestCacheInTarget(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	b := []byte("rom")
+
+	if err := ioutil.WriteFile(filepath.Join(src, "a.rom"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := NewDatafile([]byte(fmt.Sprintf(`<datafile>
+	<game name="a">
+		<description>A</description>
+		<rom name="a.rom" size="%d" crc="%08x"/>
+	</game>
+</datafile>`, len(b), crc32.ChecksumIEEE(b))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(dst, "rombo.cache")
+
+	run := func(export bool) {
+		t.Helper()
+
+		c, err := NewCache(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := New(d, log.New(ioutil.Discard, "", 0), true, nil, WithCache(c))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if export {
+			if err := r.Export(dst, []string{src}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := r.Clean(dst); err != nil {
+			t.Fatal(err)
+		}
+
+		// The cache file itself is neither deleted nor cached
+		if !export {
+			if _, err := os.Stat(file); err != nil {
+				t.Error(err)
+			}
+			if c.dirty {
+				t.Error("cache modified by an unchanged directory")
+			}
+		}
+
+		if err := c.Save(); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, name := range []string{"a.zip", "rombo.cache"} {
+			if _, err := os.Stat(filepath.Join(dst, name)); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+
+	run(true)
+	run(false)
+	run(false)
+}
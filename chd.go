@@ -0,0 +1,56 @@
+package rombo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"os"
+)
+
+const (
+	chdExtension = ".chd"
+	chdMagic     = "MComprHD"
+)
+
+// Offset of the SHA1 covering both the data and metadata within the header
+// of each CHD version that has one
+var chdSHA1Offsets = map[uint32]int{
+	3: 80,
+	4: 48,
+	5: 84,
+}
+
+// chdChecksum returns the SHA1 recorded in the header of a CHD file rather
+// than hashing what could be gigabytes of compressed data, false is
+// returned if the file isn't a CHD or is a version without a SHA1 in its
+// header, in which case it's hashed like any other file
+func chdChecksum(file string) (checksum, bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return checksum{}, false, err
+	}
+	defer f.Close()
+
+	header := make([]byte, 124)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return checksum{}, false, err
+	}
+	header = header[:n]
+
+	if len(header) < 16 || !bytes.Equal(header[:len(chdMagic)], []byte(chdMagic)) {
+		return checksum{}, false, nil
+	}
+
+	version := binary.BigEndian.Uint32(header[12:])
+	offset, ok := chdSHA1Offsets[version]
+	if !ok || len(header) < offset+20 {
+		return checksum{}, false, nil
+	}
+
+	return checksum{
+		sha1: hex.EncodeToString(header[offset : offset+20]),
+		disk: true,
+	}, true, nil
+}
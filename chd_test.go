@@ -0,0 +1,58 @@
+package rombo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func chdHeader(version uint32, length int) []byte {
+	header := make([]byte, length)
+	copy(header, chdMagic)
+	binary.BigEndian.PutUint32(header[12:], version)
+	if offset, ok := chdSHA1Offsets[version]; ok && length >= offset+20 {
+		copy(header[offset:], bytes.Repeat([]byte{0xab}, 20))
+	}
+	return header
+}
+
+func TestCHDChecksum(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		disk  bool
+	}{
+		{"v3", chdHeader(3, 120), true},
+		{"v4", chdHeader(4, 108), true},
+		{"v5", chdHeader(5, 124), true},
+		{"v1", chdHeader(1, 76), false},
+		{"v2", chdHeader(2, 80), false},
+		{"truncated", chdHeader(5, 100), false},
+		{"not a chd", []byte("this is not a chd file at all"), false},
+		{"empty", []byte{}, false},
+	}
+
+	dir := t.TempDir()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(dir, tt.name+chdExtension)
+			if err := ioutil.WriteFile(file, tt.input, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			sum, ok, err := chdChecksum(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.disk {
+				t.Fatalf("got %v, want %v", ok, tt.disk)
+			}
+			if ok && sum.sha1 != "abababababababababababababababababababab" {
+				t.Errorf("got SHA1 %s", sum.sha1)
+			}
+		})
+	}
+}
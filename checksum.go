@@ -0,0 +1,146 @@
+package rombo
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	checksumBufferSize = 4 << 20 // Large enough for CD images to not be dominated by syscalls
+)
+
+var checksumBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, checksumBufferSize)
+		return &b
+	},
+}
+
+type checksum struct {
+	size uint64
+	crc  string
+	md5  string
+	sha1 string
+	disk bool // Only the SHA1 from a CHD header is known
+}
+
+// checksumReader computes the CRC32, MD5 and SHA1 of everything read from r
+// in a single pass
+func checksumReader(r io.Reader) (checksum, error) {
+	c, m, s := crc32.NewIEEE(), md5.New(), sha1.New()
+
+	buf := checksumBufferPool.Get().(*[]byte)
+	defer checksumBufferPool.Put(buf)
+
+	// Hide any WriterTo implementation, such as *os.File, otherwise the
+	// buffer is ignored
+	size, err := io.CopyBuffer(io.MultiWriter(c, m, s), struct{ io.Reader }{r}, *buf)
+	if err != nil {
+		return checksum{}, err
+	}
+
+	return checksum{
+		size: uint64(size),
+		crc:  fmt.Sprintf("%x", c.Sum(nil)),
+		md5:  fmt.Sprintf("%x", m.Sum(nil)),
+		sha1: fmt.Sprintf("%x", s.Sum(nil)),
+	}, nil
+}
+
+func checksumFile(file string) (checksum, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return checksum{}, err
+	}
+	defer f.Close()
+
+	return checksumReader(f)
+}
+
+// checksumFile is like the package-level checksumFile but consults the
+// cache first, if there is one. CHD files are identified by the SHA1 in
+// their header instead
+func (r *Rombo) checksumFile(file string) (checksum, error) {
+	if r.cache == nil {
+		return checksumDiskOrFile(file)
+	}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		return checksum{}, err
+	}
+
+	if sum, ok := r.cache.lookup(file, "", info); ok {
+		return sum, nil
+	}
+
+	sum, err := checksumDiskOrFile(file)
+	if err != nil {
+		return checksum{}, err
+	}
+
+	r.cache.store(file, "", info, sum)
+
+	return sum, nil
+}
+
+func checksumDiskOrFile(file string) (checksum, error) {
+	if sum, ok, err := chdChecksum(file); err != nil || ok {
+		return sum, err
+	}
+	return checksumFile(file)
+}
+
+// checksumArchiveFile computes the checksum of the member f at path within
+// the archive file, or just its payload, consulting the cache first, if
+// there is one
+func (r *Rombo) checksumArchiveFile(file string, path memberPath, f archiveFile, payload *headerPayload) (checksum, error) {
+	// NUL can't appear in a member name so nested members can't collide
+	member := strings.Join(path, "\x00")
+
+	// Only whole members are cached
+	cache := r.cache
+	if payload != nil {
+		cache = nil
+	}
+
+	var info os.FileInfo
+	if cache != nil {
+		var err error
+		if info, err = os.Stat(file); err != nil {
+			return checksum{}, err
+		}
+
+		if sum, ok := cache.lookup(file, member, info); ok {
+			return sum, nil
+		}
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return checksum{}, err
+	}
+
+	fr, err := payload.wrap(rc)
+	if err != nil {
+		return checksum{}, err
+	}
+	defer fr.Close()
+
+	sum, err := checksumReader(fr)
+	if err != nil {
+		return checksum{}, err
+	}
+
+	if cache != nil {
+		cache.store(file, member, info, sum)
+	}
+
+	return sum, nil
+}
@@ -0,0 +1,60 @@
+package rombo
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestChecksumReader(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  checksum
+	}{
+		{
+			"empty",
+			"",
+			checksum{0, "00000000", "d41d8cd98f00b204e9800998ecf8427e", "da39a3ee5e6b4b0d3255bfef95601890afd80709", false},
+		},
+		{
+			"abc",
+			"abc",
+			checksum{3, "352441c2", "900150983cd24fb0d6963f7d28e17f72", "a9993e364706816aba3e25717850c26c9cd0d89d", false},
+		},
+		{
+			// Larger than the buffer so it's read in several pieces
+			"large",
+			strings.Repeat("a", checksumBufferSize+1<<20),
+			checksum{checksumBufferSize + 1<<20, "affcc16f", "79b281060d337b9b2b84ccf390adcf74", "61b8d6600ac94d912874f569a9341120f680c9f8", false},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := checksumReader(bytes.NewReader([]byte(tt.input)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+
+			// Files hide their WriterTo so should match too
+			file := filepath.Join(t.TempDir(), "file")
+			if err := ioutil.WriteFile(file, []byte(tt.input), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err = checksumFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("file: got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
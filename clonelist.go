@@ -0,0 +1,53 @@
+package rombo
+
+// resolveCloneIDs sets the parent of any game that only references it by
+// the No-Intro game id
+func resolveCloneIDs(games []*datGame) {
+	ids := make(map[string]string, len(games))
+	for _, game := range games {
+		if game.ID != "" {
+			ids[game.ID] = game.Name
+		}
+	}
+
+	for _, game := range games {
+		if game.CloneOf != "" || game.CloneOfID == "" {
+			continue
+		}
+		if parent, ok := ids[game.CloneOfID]; ok && parent != game.Name {
+			game.CloneOf = parent
+		}
+	}
+}
+
+// ApplyCloneList reads a parent/clone list, such as the separate P/C XML
+// that No-Intro publish, in any supported datafile format and groups the
+// games in the datafile accordingly. Parents are taken from either the
+// cloneof or the No-Intro cloneofid attributes and any game or parent not
+// in the datafile is ignored
+func (d *Datafile) ApplyCloneList(b []byte) error {
+	list, _, err := parseDatafile(b)
+	if err != nil {
+		return err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	games := make(map[string]*datGame, len(d.games))
+	for _, game := range d.games {
+		games[game.Name] = game
+	}
+
+	for _, clone := range list.Games {
+		game, ok := games[clone.Name]
+		if !ok || clone.CloneOf == "" || games[clone.CloneOf] == nil {
+			continue
+		}
+		game.CloneOf = clone.CloneOf
+	}
+
+	d.reindex()
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package rombo
+
+import "testing"
+
+func TestResolveCloneIDs(t *testing.T) {
+	games := []*datGame{
+		{Name: "Game (USA)", ID: "0001", CloneOfID: "0002"},
+		{Name: "Game (Japan)", ID: "0002"},
+		{Name: "Game (Europe)", ID: "0003", CloneOf: "Game (Japan)", CloneOfID: "0001"},
+		{Name: "Other (USA)", ID: "0004", CloneOfID: "0099"},
+		{Name: "Self (USA)", ID: "0005", CloneOfID: "0005"},
+	}
+
+	resolveCloneIDs(games)
+
+	want := map[string]string{
+		"Game (USA)":    "Game (Japan)",
+		"Game (Japan)":  "",
+		"Game (Europe)": "Game (Japan)",
+		"Other (USA)":   "",
+		"Self (USA)":    "",
+	}
+
+	for _, game := range games {
+		if game.CloneOf != want[game.Name] {
+			t.Errorf("%s: cloneof %q, want %q", game.Name, game.CloneOf, want[game.Name])
+		}
+	}
+}
+
+const testCloneListDatafile = `<?xml version="1.0"?>
+<datafile>
+	<header><name>Test</name></header>
+	<game name="Game (Japan)"><description>Game (Japan)</description><rom name="a.rom" size="1" crc="00000001"/></game>
+	<game name="Game (USA)"><description>Game (USA)</description><rom name="b.rom" size="1" crc="00000002"/></game>
+	<game name="Game (Europe)"><description>Game (Europe)</description><rom name="c.rom" size="1" crc="00000003"/></game>
+	<game name="Other (USA)"><description>Other (USA)</description><rom name="d.rom" size="1" crc="00000004"/></game>
+</datafile>`
+
+const testCloneList = `<?xml version="1.0"?>
+<datafile>
+	<header><name>Clones</name></header>
+	<game name="Game (Japan)" id="0001"><description>Game (Japan)</description></game>
+	<game name="Game (USA)" id="0002" cloneofid="0001"><description>Game (USA)</description></game>
+	<game name="Game (Europe)" cloneof="Game (USA)"><description>Game (Europe)</description></game>
+	<game name="Other (USA)" cloneof="Missing (USA)"><description>Other (USA)</description></game>
+	<game name="Missing (Japan)" cloneof="Game (Japan)"><description>Missing (Japan)</description></game>
+</datafile>`
+
+func TestApplyCloneList(t *testing.T) {
+	d, err := NewDatafile([]byte(testCloneListDatafile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.ApplyCloneList([]byte(testCloneList)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		crc            string
+		cloneOf, group string
+	}{
+		{"00000001", "", "Game (Japan)"},
+		{"00000002", "Game (Japan)", "Game (Japan)"},
+		{"00000003", "Game (USA)", "Game (Japan)"},
+		{"00000004", "", "Other (USA)"},
+	}
+
+	for _, tt := range tests {
+		roms, ok, err := d.findROMByCRC(1, tt.crc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok || len(roms) != 1 {
+			t.Fatalf("%s: found %d roms", tt.crc, len(roms))
+		}
+		rom := roms[0]
+
+		if rom.CloneOf != tt.cloneOf {
+			t.Errorf("%s: cloneof %q, want %q", rom.Game, rom.CloneOf, tt.cloneOf)
+		}
+
+		p, _, _, err := SimpleGrouped{}.exportPath(rom)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := tt.group + "/" + rom.Game + ".zip"; p != want {
+			t.Errorf("%s: exported to %q, want %q", rom.Game, p, want)
+		}
+	}
+
+	if d.games[3].CloneOf != "" {
+		t.Errorf("unknown parent applied to %s", d.games[3].Name)
+	}
+	if len(d.games) != 4 {
+		t.Errorf("got %d games, want 4", len(d.games))
+	}
+}
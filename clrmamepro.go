@@ -0,0 +1,418 @@
+package rombo
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type cmpToken struct {
+	text   string
+	quoted bool
+}
+
+type cmpNode struct {
+	key      string
+	value    string
+	children []*cmpNode
+}
+
+func (n *cmpNode) block() bool {
+	return n.children != nil
+}
+
+func cmpTokenize(b []byte) ([]cmpToken, error) {
+	var tokens []cmpToken
+
+	s := string(bytes.TrimPrefix(b, []byte("\xef\xbb\xbf")))
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '"':
+			text, n, err := cmpUnquote(s[i:])
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, cmpToken{text, true})
+			i += n
+		case c == '(' || c == ')':
+			// Brackets don't need any surrounding whitespace
+			tokens = append(tokens, cmpToken{s[i : i+1], false})
+			i++
+		default:
+			j := strings.IndexFunc(s[i:], func(r rune) bool {
+				return unicode.IsSpace(r) || r == '(' || r == ')'
+			})
+			if j < 0 {
+				j = len(s) - i
+			}
+			tokens = append(tokens, cmpToken{s[i : i+j], false})
+			i += j
+		}
+	}
+
+	return tokens, nil
+}
+
+// cmpUnquote reads the quoted string at the start of s, returning its value
+// and length. A backslash only escapes a following quote or backslash so
+// paths using backslashes as separators are read unchanged
+func cmpUnquote(s string) (string, int, error) {
+	var b strings.Builder
+
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"':
+			return b.String(), i + 1, nil
+		case c == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\'):
+			i++
+			b.WriteByte(s[i])
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return "", 0, errors.New("unterminated quoted string")
+}
+
+// cmpQuote is the inverse of cmpUnquote, only escaping a backslash where
+// it would otherwise be read as an escape
+func cmpQuote(value string) string {
+	var b strings.Builder
+
+	b.WriteByte('"')
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case c == '"':
+			b.WriteString(`\"`)
+		case c == '\\' && (i+1 == len(value) || value[i+1] == '"' || value[i+1] == '\\'):
+			b.WriteString(`\\`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+
+	return b.String()
+}
+
+func cmpParseBlock(tokens []cmpToken, nested bool) ([]*cmpNode, []cmpToken, error) {
+	nodes := []*cmpNode{}
+
+	for len(tokens) > 0 {
+		key := tokens[0]
+		if !key.quoted && key.text == ")" {
+			if !nested {
+				return nil, nil, errors.New("unexpected )")
+			}
+			return nodes, tokens[1:], nil
+		}
+		if key.quoted || key.text == "(" {
+			return nil, nil, fmt.Errorf("unexpected %q", key.text)
+		}
+
+		if len(tokens) < 2 {
+			return nil, nil, fmt.Errorf("missing value for %s", key.text)
+		}
+
+		node := cmpNode{key: key.text}
+
+		value := tokens[1]
+		if !value.quoted && value.text == "(" {
+			children, rest, err := cmpParseBlock(tokens[2:], true)
+			if err != nil {
+				return nil, nil, err
+			}
+			node.children = children
+			tokens = rest
+		} else {
+			node.value = value.text
+			tokens = tokens[2:]
+		}
+
+		nodes = append(nodes, &node)
+	}
+
+	if nested {
+		return nil, nil, errors.New("unexpected end of file")
+	}
+
+	return nodes, nil, nil
+}
+
+func cmpHeader(node *cmpNode) *datHeader {
+	header := datHeader{}
+
+	for _, child := range node.children {
+		switch child.key {
+		case "name":
+			header.Name = child.value
+		case "description":
+			header.Description = child.value
+		case "category":
+			header.Category = child.value
+		case "version":
+			header.Version = child.value
+		case "date":
+			header.Date = child.value
+		case "author":
+			header.Author = child.value
+		case "email":
+			header.Email = child.value
+		case "homepage":
+			header.Homepage = child.value
+		case "url":
+			header.URL = child.value
+		case "comment":
+			header.Comment = child.value
+		case "header", "forcemerging", "forcenodump", "forcepacking":
+			if header.ClrMamePro == nil {
+				header.ClrMamePro = &datClrMamePro{}
+			}
+			switch child.key {
+			case "header":
+				header.ClrMamePro.Header = child.value
+			case "forcemerging":
+				header.ClrMamePro.ForceMerging = child.value
+			case "forcenodump":
+				header.ClrMamePro.ForceNodump = child.value
+			case "forcepacking":
+				header.ClrMamePro.ForcePacking = child.value
+			}
+		}
+	}
+
+	return &header
+}
+
+func cmpROM(node *cmpNode) (*datROM, error) {
+	rom := datROM{}
+
+	for _, child := range node.children {
+		switch child.key {
+		case "name":
+			rom.Name = child.value
+		case "size":
+			size, err := strconv.ParseUint(child.value, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			rom.Size = size
+		case "crc":
+			rom.CRC = child.value
+		case "md5":
+			rom.MD5 = child.value
+		case "sha1":
+			rom.SHA1 = child.value
+		case "merge":
+			rom.Merge = child.value
+		case "flags":
+			rom.Status = child.value
+		case "date":
+			rom.Date = child.value
+		}
+	}
+
+	return &rom, nil
+}
+
+func cmpDisk(node *cmpNode) *datDisk {
+	disk := datDisk{}
+
+	for _, child := range node.children {
+		switch child.key {
+		case "name":
+			disk.Name = child.value
+		case "sha1":
+			disk.SHA1 = child.value
+		case "md5":
+			disk.MD5 = child.value
+		case "merge":
+			disk.Merge = child.value
+		case "flags":
+			disk.Status = child.value
+		}
+	}
+
+	return &disk
+}
+
+func cmpGame(node *cmpNode) (*datGame, error) {
+	game := datGame{}
+
+	if node.key == "resource" {
+		game.IsBIOS = "yes"
+	}
+
+	for _, child := range node.children {
+		switch child.key {
+		case "name":
+			game.Name = child.value
+		case "description":
+			game.Description = child.value
+		case "year":
+			game.Year = child.value
+		case "manufacturer":
+			game.Manufacturer = child.value
+		case "cloneof":
+			game.CloneOf = child.value
+		case "romof":
+			game.RomOf = child.value
+		case "sampleof":
+			game.SampleOf = child.value
+		case "comment":
+			game.Comment = append(game.Comment, child.value)
+		case "rom":
+			if !child.block() {
+				return nil, fmt.Errorf("rom in %s is not a block", game.Name)
+			}
+			rom, err := cmpROM(child)
+			if err != nil {
+				return nil, err
+			}
+			game.ROMs = append(game.ROMs, rom)
+		case "disk":
+			if !child.block() {
+				return nil, fmt.Errorf("disk in %s is not a block", game.Name)
+			}
+			game.Disks = append(game.Disks, cmpDisk(child))
+		}
+	}
+
+	return &game, nil
+}
+
+func cmpParse(b []byte) (*datDocument, error) {
+	tokens, err := cmpTokenize(b)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes, _, err := cmpParseBlock(tokens, false)
+	if err != nil {
+		return nil, err
+	}
+
+	document := datDocument{}
+
+	for _, node := range nodes {
+		if !node.block() {
+			return nil, fmt.Errorf("%s is not a block", node.key)
+		}
+
+		switch node.key {
+		case "clrmamepro":
+			document.Header = cmpHeader(node)
+		case "game", "machine", "resource":
+			game, err := cmpGame(node)
+			if err != nil {
+				return nil, err
+			}
+			document.Games = append(document.Games, game)
+		default:
+			// Ignore anything else, such as emulator blocks
+		}
+	}
+
+	return &document, nil
+}
+
+func cmpWriteValue(buf *bytes.Buffer, indent, key, value string, quote bool) {
+	if value == "" {
+		return
+	}
+	if quote {
+		value = cmpQuote(value)
+	}
+	fmt.Fprintf(buf, "%s%s %s\n", indent, key, value)
+}
+
+func cmpMarshal(document *datDocument) []byte {
+	buf := new(bytes.Buffer)
+
+	if header := document.Header; header != nil {
+		buf.WriteString("clrmamepro (\n")
+		cmpWriteValue(buf, "\t", "name", header.Name, true)
+		cmpWriteValue(buf, "\t", "description", header.Description, true)
+		cmpWriteValue(buf, "\t", "category", header.Category, true)
+		cmpWriteValue(buf, "\t", "version", header.Version, true)
+		cmpWriteValue(buf, "\t", "date", header.Date, true)
+		cmpWriteValue(buf, "\t", "author", header.Author, true)
+		cmpWriteValue(buf, "\t", "email", header.Email, true)
+		cmpWriteValue(buf, "\t", "homepage", header.Homepage, true)
+		cmpWriteValue(buf, "\t", "url", header.URL, true)
+		cmpWriteValue(buf, "\t", "comment", header.Comment, true)
+		if header.ClrMamePro != nil {
+			cmpWriteValue(buf, "\t", "header", header.ClrMamePro.Header, true)
+			cmpWriteValue(buf, "\t", "forcemerging", header.ClrMamePro.ForceMerging, false)
+			cmpWriteValue(buf, "\t", "forcenodump", header.ClrMamePro.ForceNodump, false)
+			cmpWriteValue(buf, "\t", "forcepacking", header.ClrMamePro.ForcePacking, false)
+		}
+		buf.WriteString(")\n")
+	}
+
+	for _, game := range document.Games {
+		if game.IsBIOS == "yes" {
+			buf.WriteString("\nresource (\n")
+		} else {
+			buf.WriteString("\ngame (\n")
+		}
+		cmpWriteValue(buf, "\t", "name", game.Name, true)
+		for _, comment := range game.Comment {
+			cmpWriteValue(buf, "\t", "comment", comment, true)
+		}
+		cmpWriteValue(buf, "\t", "description", game.Description, true)
+		cmpWriteValue(buf, "\t", "year", game.Year, true)
+		cmpWriteValue(buf, "\t", "manufacturer", game.Manufacturer, true)
+		cmpWriteValue(buf, "\t", "cloneof", game.CloneOf, true)
+		cmpWriteValue(buf, "\t", "romof", game.RomOf, true)
+		cmpWriteValue(buf, "\t", "sampleof", game.SampleOf, true)
+		for _, rom := range game.ROMs {
+			buf.WriteString("\trom ( ")
+			fmt.Fprintf(buf, "name %s size %d ", cmpQuote(rom.Name), rom.Size)
+			if rom.CRC != "" {
+				fmt.Fprintf(buf, "crc %s ", rom.CRC)
+			}
+			if rom.MD5 != "" {
+				fmt.Fprintf(buf, "md5 %s ", rom.MD5)
+			}
+			if rom.SHA1 != "" {
+				fmt.Fprintf(buf, "sha1 %s ", rom.SHA1)
+			}
+			if rom.Merge != "" {
+				fmt.Fprintf(buf, "merge %s ", cmpQuote(rom.Merge))
+			}
+			if rom.Status != "" {
+				fmt.Fprintf(buf, "flags %s ", rom.Status)
+			}
+			if rom.Date != "" {
+				fmt.Fprintf(buf, "date %s ", cmpQuote(rom.Date))
+			}
+			buf.WriteString(")\n")
+		}
+		for _, disk := range game.Disks {
+			buf.WriteString("\tdisk ( ")
+			fmt.Fprintf(buf, "name %s ", cmpQuote(disk.Name))
+			if disk.SHA1 != "" {
+				fmt.Fprintf(buf, "sha1 %s ", disk.SHA1)
+			}
+			if disk.MD5 != "" {
+				fmt.Fprintf(buf, "md5 %s ", disk.MD5)
+			}
+			if disk.Merge != "" {
+				fmt.Fprintf(buf, "merge %s ", cmpQuote(disk.Merge))
+			}
+			if disk.Status != "" {
+				fmt.Fprintf(buf, "flags %s ", disk.Status)
+			}
+			buf.WriteString(")\n")
+		}
+		buf.WriteString(")\n")
+	}
+
+	return buf.Bytes()
+}
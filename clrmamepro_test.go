@@ -0,0 +1,198 @@
+package rombo
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCMPTokenize(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []cmpToken
+	}{
+		{
+			name:  "spaced",
+			input: `rom ( name "a b" size 1 )`,
+			want: []cmpToken{
+				{"rom", false}, {"(", false}, {"name", false}, {"a b", true}, {"size", false}, {"1", false}, {")", false},
+			},
+		},
+		{
+			name:  "unspaced",
+			input: `rom (name "a"size 1 crc 00000001)`,
+			want: []cmpToken{
+				{"rom", false}, {"(", false}, {"name", false}, {"a", true}, {"size", false}, {"1", false}, {"crc", false}, {"00000001", false}, {")", false},
+			},
+		},
+		{
+			name:  "brackets in quotes",
+			input: "name \"Game (USA)\"\r\n",
+			want: []cmpToken{
+				{"name", false}, {"Game (USA)", true},
+			},
+		},
+		{
+			name:  "escaped quotes",
+			input: `name "Jeopardy! \"Sports Edition\" \\"`,
+			want: []cmpToken{
+				{"name", false}, {`Jeopardy! "Sports Edition" \`, true},
+			},
+		},
+		{
+			name:  "backslash path",
+			input: `name "dir\file.bin"`,
+			want: []cmpToken{
+				{"name", false}, {`dir\file.bin`, true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cmpTokenize([]byte(tt.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCMPParseErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"unterminated block", `game ( name "a"`},
+		{"unterminated string", `game ( name "a )`},
+		{"unexpected bracket", `game ( name "a" ) )`},
+		{"not a block", `game "a"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := cmpParse([]byte(tt.input)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+const cmpDatafile = `clrmamepro (
+	name "Test"
+	description "Test (20200101)"
+	version 20200101
+	header "No-Intro_NES.xml"
+	forcemerging full
+)
+
+emulator (
+	name "Ignored"
+)
+
+game (
+	name "Parent (USA)"
+	description "Parent (USA)"
+	rom ( name "Parent (USA).bin" size 16 crc 0A1B2C3D md5 00112233445566778899aabbccddeeff sha1 0011223344556677889900112233445566778899 )
+	rom (name "Bad.bin" size 1 crc 00000001 flags baddump)
+)
+
+game (
+	name "Clone (Europe)"
+	description "Clone (Europe)"
+	cloneof "Parent (USA)"
+	romof "Parent (USA)"
+	rom ( name "Parent (USA).bin" merge "Parent (USA).bin" size 16 crc 0a1b2c3d )
+	disk ( name "disc" sha1 1111111111111111111111111111111111111111 )
+)
+
+resource (
+	name "bios"
+	description "BIOS"
+	rom ( name "bios.rom" size 2 crc 00000002 )
+)
+`
+
+func TestCMPParse(t *testing.T) {
+	d, err := NewDatafile([]byte(cmpDatafile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d.Format() != ClrMamePro {
+		t.Fatalf("got format %d, want %d", d.Format(), ClrMamePro)
+	}
+
+	if d.header.Name != "Test" || d.header.Version != "20200101" {
+		t.Errorf("unexpected header %+v", d.header)
+	}
+	if d.header.ClrMamePro == nil || d.header.ClrMamePro.Header != "No-Intro_NES.xml" || d.header.ClrMamePro.ForceMerging != "full" {
+		t.Errorf("unexpected clrmamepro header %+v", d.header.ClrMamePro)
+	}
+
+	if len(d.games) != 3 {
+		t.Fatalf("got %d games, want 3", len(d.games))
+	}
+
+	parent, clone, bios := d.games[0], d.games[1], d.games[2]
+	if len(parent.ROMs) != 2 || parent.ROMs[0].CRC != "0a1b2c3d" || parent.ROMs[0].Size != 16 || parent.ROMs[1].Status != statusBadDump {
+		t.Errorf("unexpected parent ROMs %+v", parent.ROMs)
+	}
+	if clone.CloneOf != "Parent (USA)" || clone.ROMs[0].Merge != "Parent (USA).bin" {
+		t.Errorf("unexpected clone %+v", clone)
+	}
+	if len(clone.Disks) != 1 || clone.Disks[0].Name != "disc" {
+		t.Errorf("unexpected clone disks %+v", clone.Disks)
+	}
+	if bios.IsBIOS != "yes" {
+		t.Errorf("resource not marked as BIOS")
+	}
+}
+
+func TestCMPMarshalRoundTrip(t *testing.T) {
+	document, err := cmpParse([]byte(cmpDatafile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := cmpParse(cmpMarshal(document))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(document, again) {
+		t.Errorf("got %+v, want %+v", again, document)
+	}
+}
+
+func TestCMPMarshalQuotes(t *testing.T) {
+	names := []string{
+		`Jeopardy! "Sports Edition" (USA)`,
+		`"Quoted"`,
+		`dir\file.bin`,
+		`dir\`,
+		`dir\\"file"`,
+	}
+
+	document := &datDocument{Header: &datHeader{Name: `Test "Quotes"`}}
+	for _, name := range names {
+		document.Games = append(document.Games, &datGame{
+			Name:        name,
+			Description: name,
+			ROMs:        []*datROM{{Name: name, Size: 1, CRC: "00000001", Merge: name}},
+			Disks:       []*datDisk{{Name: name, SHA1: "1111111111111111111111111111111111111111"}},
+		})
+	}
+
+	again, err := cmpParse(cmpMarshal(document))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(document, again) {
+		t.Errorf("got %+v, want %+v", again, document)
+	}
+}
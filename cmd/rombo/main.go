@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 	"time"
@@ -15,12 +16,27 @@ import (
 
 var stringToLayout = map[string]rombo.Layout{
 	"simple":      rombo.SimpleCompressed{},
+	"simple-zstd": rombo.SimpleZstd{},
+	"grouped":     rombo.SimpleGrouped{},
 	"jaguar":      rombo.JaguarGD{},
 	"megasd":      rombo.MegaSD{},
 	"sd2snes":     rombo.SD2SNES{},
 	"everdrive64": rombo.Everdrive64{},
 }
 
+var stringToDuplicates = map[string]rombo.Duplicates{
+	"first": rombo.KeepFirst,
+	"last":  rombo.KeepLast,
+	"error": rombo.DuplicateError,
+	"union": rombo.Union,
+}
+
+var stringToSetMode = map[string]rombo.SetMode{
+	"non-merged": rombo.NonMerged,
+	"split":      rombo.Split,
+	"merged":     rombo.Merged,
+}
+
 type EnumValue struct {
 	Enum     []string
 	Default  string
@@ -52,6 +68,106 @@ func init() {
 	}
 }
 
+func listDumps(datafile *rombo.Datafile) {
+	for _, rom := range datafile.NoDumps() {
+		fmt.Fprintf(os.Stderr, "No dump: \"%s\" in \"%s\"\n", rom.Filename, rom.Game)
+	}
+	for _, rom := range datafile.BadDumps() {
+		fmt.Fprintf(os.Stderr, "Bad dump: \"%s\" in \"%s\"\n", rom.Filename, rom.Game)
+	}
+}
+
+func applyCloneList(c *cli.Context, datafile *rombo.Datafile) error {
+	if c.String("clone-list") == "" {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(c.String("clone-list"))
+	if err != nil {
+		return err
+	}
+
+	return datafile.ApplyCloneList(b)
+}
+
+func filter(c *cli.Context, datafile *rombo.Datafile) {
+	if c.IsSet("include") || c.IsSet("exclude") || c.Bool("1g1r") {
+		datafile.Filter(rombo.Filter{
+			Include:        c.StringSlice("include"),
+			Exclude:        c.StringSlice("exclude"),
+			OneGameOneROM:  c.Bool("1g1r"),
+			RegionPriority: c.StringSlice("region"),
+		})
+	}
+}
+
+func dir2dat(c *cli.Context) error {
+	if c.NArg() < 1 {
+		cli.ShowCommandHelpAndExit(c, c.Command.FullName(), 1)
+	}
+
+	logger := log.New(ioutil.Discard, "", 0)
+	if c.Bool("verbose") {
+		logger.SetOutput(os.Stderr)
+	}
+
+	datafile := rombo.NewEmptyDatafile()
+
+	var options []rombo.Option
+
+	var cache *rombo.Cache
+	if c.String("cache") != "" {
+		var err error
+		cache, err = rombo.NewCache(c.String("cache"))
+		if err != nil {
+			return cli.NewExitError(err, 1)
+		}
+		options = append(options, rombo.WithCache(cache))
+	}
+
+	r, err := rombo.New(datafile, logger, false, nil, options...)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	start := time.Now()
+	if err := r.Dir2Dat(c.Args()); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	elapsed := time.Since(start)
+
+	logger.Println("Dir2Dat finished in", elapsed)
+
+	if cache != nil {
+		if err := cache.Save(); err != nil {
+			return cli.NewExitError(err, 1)
+		}
+	}
+
+	name := c.String("set-name")
+	if name == "" {
+		abs, err := filepath.Abs(c.Args().First())
+		if err != nil {
+			return cli.NewExitError(err, 1)
+		}
+		name = filepath.Base(abs)
+	}
+
+	description := c.String("set-description")
+	if description == "" {
+		description = name
+	}
+
+	datafile.OverrideHeader(name, description, c.String("set-version"), c.String("set-author"))
+
+	_, err = os.Stdout.Write(datafile.Marshal())
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	return nil
+}
+
 func export(c *cli.Context) error {
 	if c.NArg() < 2 {
 		cli.ShowCommandHelpAndExit(c, c.Command.FullName(), 1)
@@ -72,9 +188,36 @@ func export(c *cli.Context) error {
 		return cli.NewExitError(err, 1)
 	}
 
+	if err := applyCloneList(c, datafile); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	filter(c, datafile)
+
 	layout := stringToLayout[c.Generic("layout").(*EnumValue).String()]
 
-	r, err := rombo.New(datafile, logger, !c.Bool("dry-run"), layout)
+	options := []rombo.Option{
+		rombo.WithSetMode(stringToSetMode[c.Generic("set-mode").(*EnumValue).String()]),
+	}
+
+	var cache *rombo.Cache
+	if c.String("cache") != "" {
+		cache, err = rombo.NewCache(c.String("cache"))
+		if err != nil {
+			return cli.NewExitError(err, 1)
+		}
+		options = append(options, rombo.WithCache(cache))
+	}
+
+	if c.IsSet("depth") {
+		options = append(options, rombo.WithDepth(c.Int("depth")))
+	}
+
+	if c.String("headers") != "" {
+		options = append(options, rombo.WithHeaderDirectory(c.String("headers")))
+	}
+
+	r, err := rombo.New(datafile, logger, !c.Bool("dry-run"), layout, options...)
 	if err != nil {
 		return cli.NewExitError(err, 1)
 	}
@@ -95,20 +238,38 @@ func export(c *cli.Context) error {
 
 	logger.Println("Clean finished in", elapsed)
 
+	if cache != nil {
+		if err := cache.Save(); err != nil {
+			return cli.NewExitError(err, 1)
+		}
+	}
+
+	if c.Bool("list-dumps") {
+		listDumps(datafile)
+	}
+
 	games, err := datafile.GamesRemaining()
 	if err != nil {
 		return cli.NewExitError(err, 1)
 	}
 
 	if games > 0 {
-		output := datafile.Marshal()
+		format := rombo.Logiqx
+		if c.Bool("keep-format") && datafile.Format() != rombo.SoftwareList {
+			format = datafile.Format()
+		}
+
+		output, err := datafile.Fixdat(format, c.Bool("annotate"))
+		if err != nil {
+			return cli.NewExitError(err, 1)
+		}
 
 		_, err = os.Stdout.Write(output)
 		if err != nil {
 			return cli.NewExitError(err, 1)
 		}
 
-		cli.NewExitError("", 2)
+		return cli.NewExitError("", 2)
 	}
 
 	return nil
@@ -129,17 +290,21 @@ func merge(c *cli.Context) error {
 		return cli.NewExitError(err, 1)
 	}
 
+	duplicates := stringToDuplicates[c.Generic("duplicates").(*EnumValue).String()]
+
 	for _, file := range c.Args().Tail() {
 		b, err := ioutil.ReadFile(file)
 		if err != nil {
-			cli.NewExitError(err, 1)
+			return cli.NewExitError(err, 1)
 		}
 
-		if err := datafile.Merge(b); err != nil {
-			cli.NewExitError(err, 1)
+		if err := datafile.Merge(b, duplicates); err != nil {
+			return cli.NewExitError(err, 1)
 		}
 	}
 
+	datafile.OverrideHeader(c.String("set-name"), c.String("set-description"), c.String("set-version"), c.String("set-author"))
+
 	_, err = os.Stdout.Write(datafile.Marshal())
 	if err != nil {
 		log.Fatal(err)
@@ -168,7 +333,32 @@ func verify(c *cli.Context) error {
 		return cli.NewExitError(err, 1)
 	}
 
-	r, err := rombo.New(datafile, logger, false, nil)
+	if err := applyCloneList(c, datafile); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	filter(c, datafile)
+
+	var options []rombo.Option
+
+	var cache *rombo.Cache
+	if c.String("cache") != "" {
+		cache, err = rombo.NewCache(c.String("cache"))
+		if err != nil {
+			return cli.NewExitError(err, 1)
+		}
+		options = append(options, rombo.WithCache(cache))
+	}
+
+	if c.IsSet("depth") {
+		options = append(options, rombo.WithDepth(c.Int("depth")))
+	}
+
+	if c.String("headers") != "" {
+		options = append(options, rombo.WithHeaderDirectory(c.String("headers")))
+	}
+
+	r, err := rombo.New(datafile, logger, false, nil, options...)
 	if err != nil {
 		return cli.NewExitError(err, 1)
 	}
@@ -181,20 +371,38 @@ func verify(c *cli.Context) error {
 
 	logger.Println("Verify finished in", elapsed)
 
+	if cache != nil {
+		if err := cache.Save(); err != nil {
+			return cli.NewExitError(err, 1)
+		}
+	}
+
+	if c.Bool("list-dumps") {
+		listDumps(datafile)
+	}
+
 	games, err := datafile.GamesRemaining()
 	if err != nil {
 		return cli.NewExitError(err, 1)
 	}
 
 	if games > 0 {
-		output := datafile.Marshal()
+		format := rombo.Logiqx
+		if c.Bool("keep-format") && datafile.Format() != rombo.SoftwareList {
+			format = datafile.Format()
+		}
+
+		output, err := datafile.Fixdat(format, c.Bool("annotate"))
+		if err != nil {
+			return cli.NewExitError(err, 1)
+		}
 
 		_, err = os.Stdout.Write(output)
 		if err != nil {
 			return cli.NewExitError(err, 1)
 		}
 
-		cli.NewExitError("", 2)
+		return cli.NewExitError("", 2)
 	}
 
 	return nil
@@ -213,17 +421,98 @@ func main() {
 	}
 	sort.Sort(sort.StringSlice(layouts))
 
+	duplicates := make([]string, 0, len(stringToDuplicates))
+	for k := range stringToDuplicates {
+		duplicates = append(duplicates, k)
+	}
+	sort.Sort(sort.StringSlice(duplicates))
+
+	setModes := make([]string, 0, len(stringToSetMode))
+	for k := range stringToSetMode {
+		setModes = append(setModes, k)
+	}
+	sort.Sort(sort.StringSlice(setModes))
+
 	app.Commands = []cli.Command{
+		{
+			Name:        "dir2dat",
+			Usage:       "Create a dat file from the ROMs found in one or more directories",
+			Description: "Each archive becomes a game, as does each directory of loose files, and the dat file is written to standard output in Logiqx XML format",
+			ArgsUsage:   "DIR...",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "cache",
+					Usage: "cache checksums of unchanged files in `FILE` between runs",
+				},
+				cli.StringFlag{
+					Name:  "set-name",
+					Usage: "Set the name, defaults to the name of the first directory",
+				},
+				cli.StringFlag{
+					Name:  "set-description",
+					Usage: "Set the description, defaults to the name",
+				},
+				cli.StringFlag{
+					Name:  "set-version",
+					Usage: "Set the version",
+				},
+				cli.StringFlag{
+					Name:  "set-author",
+					Usage: "Set the author",
+				},
+				cli.BoolFlag{
+					Name:  "verbose, v",
+					Usage: "increase verbosity",
+				},
+			},
+			Action: dir2dat,
+		},
 		{
 			Name:        "export",
 			Usage:       "Create or update a target directory using the ROMs found in one or more source directories",
-			Description: "The XML dat file is read from the standard input and a partial XML dat file containing any missing ROM is written to standard output",
+			Description: "The Logiqx XML, ClrMamePro, RomCenter or MAME software list dat file is read from the standard input and a fixdat containing any missing ROM is written to standard output",
 			ArgsUsage:   "TARGET SOURCE...",
 			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "1g1r",
+					Usage: "keep only the best game from each parent/clone group",
+				},
+				cli.BoolFlag{
+					Name:  "annotate",
+					Usage: "annotate each game in the partial dat file with which ROMs are missing or bad",
+				},
+				cli.StringFlag{
+					Name:  "cache",
+					Usage: "cache checksums of unchanged files in `FILE` between runs",
+				},
+				cli.StringFlag{
+					Name:  "clone-list",
+					Usage: "group games into parents and clones using the parent/clone dat file `FILE`",
+				},
+				cli.IntFlag{
+					Name:  "depth",
+					Usage: "look inside archives nested up to `N` levels deep within other archives",
+				},
 				cli.BoolFlag{
 					Name:  "dry-run, n",
 					Usage: "don't actually do anything",
 				},
+				cli.StringSliceFlag{
+					Name:  "exclude",
+					Usage: "drop games with `TAG`, such as beta, proto or bios. May be repeated",
+				},
+				cli.StringFlag{
+					Name:  "headers",
+					Usage: "look for the header detector referenced by the dat file in `DIR`",
+				},
+				cli.StringSliceFlag{
+					Name:  "include",
+					Usage: "keep only games with `TAG`, such as usa or en. May be repeated",
+				},
+				cli.BoolFlag{
+					Name:  "keep-format",
+					Usage: "write any missing ROMs in the same format as the input dat file",
+				},
 				cli.GenericFlag{
 					Name: "layout",
 					Value: &EnumValue{
@@ -232,6 +521,22 @@ func main() {
 					},
 					Usage: "organise the exported ROMs according to `LAYOUT`. (" + strings.Join(layouts, ", ") + ")",
 				},
+				cli.BoolFlag{
+					Name:  "list-dumps",
+					Usage: "list any ROMs that have never been dumped or were found but are bad dumps on standard error",
+				},
+				cli.StringSliceFlag{
+					Name:  "region",
+					Usage: "prefer games from `REGION` with --1g1r. May be repeated, best first",
+				},
+				cli.GenericFlag{
+					Name: "set-mode",
+					Value: &EnumValue{
+						Enum:    setModes,
+						Default: "non-merged",
+					},
+					Usage: "store parent and clone sets as `MODE`. (" + strings.Join(setModes, ", ") + ")",
+				},
 				cli.BoolFlag{
 					Name:  "verbose, v",
 					Usage: "increase verbosity",
@@ -241,10 +546,18 @@ func main() {
 		},
 		{
 			Name:        "merge",
-			Usage:       "Merge multiple XML dat files together",
-			Description: "The merged XML file is written to standard output",
+			Usage:       "Merge multiple dat files together",
+			Description: "The merged dat file is written to standard output in Logiqx XML format",
 			ArgsUsage:   "FILE...",
 			Flags: []cli.Flag{
+				cli.GenericFlag{
+					Name: "duplicates",
+					Value: &EnumValue{
+						Enum:    duplicates,
+						Default: "first",
+					},
+					Usage: "handle games with the same name in more than one dat file by `POLICY`. (" + strings.Join(duplicates, ", ") + ")",
+				},
 				cli.StringFlag{
 					Name:  "set-name",
 					Usage: "Override the name",
@@ -266,10 +579,54 @@ func main() {
 		},
 		{
 			Name:        "verify",
-			Usage:       "Verify the contents of one or more directories against an XML dat file",
-			Description: "The XML dat file is read from the standard input and a partial XML dat file containing any missing ROM is written to standard output",
+			Usage:       "Verify the contents of one or more directories against a Logiqx XML, ClrMamePro, RomCenter or MAME software list dat file",
+			Description: "The Logiqx XML, ClrMamePro, RomCenter or MAME software list dat file is read from the standard input and a fixdat containing any missing ROM is written to standard output",
 			ArgsUsage:   "DIRECTORY...",
 			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "1g1r",
+					Usage: "keep only the best game from each parent/clone group",
+				},
+				cli.BoolFlag{
+					Name:  "annotate",
+					Usage: "annotate each game in the partial dat file with which ROMs are missing or bad",
+				},
+				cli.StringFlag{
+					Name:  "cache",
+					Usage: "cache checksums of unchanged files in `FILE` between runs",
+				},
+				cli.StringFlag{
+					Name:  "clone-list",
+					Usage: "group games into parents and clones using the parent/clone dat file `FILE`",
+				},
+				cli.IntFlag{
+					Name:  "depth",
+					Usage: "look inside archives nested up to `N` levels deep within other archives",
+				},
+				cli.StringSliceFlag{
+					Name:  "exclude",
+					Usage: "drop games with `TAG`, such as beta, proto or bios. May be repeated",
+				},
+				cli.StringFlag{
+					Name:  "headers",
+					Usage: "look for the header detector referenced by the dat file in `DIR`",
+				},
+				cli.StringSliceFlag{
+					Name:  "include",
+					Usage: "keep only games with `TAG`, such as usa or en. May be repeated",
+				},
+				cli.BoolFlag{
+					Name:  "keep-format",
+					Usage: "write any missing ROMs in the same format as the input dat file",
+				},
+				cli.BoolFlag{
+					Name:  "list-dumps",
+					Usage: "list any ROMs that have never been dumped or were found but are bad dumps on standard error",
+				},
+				cli.StringSliceFlag{
+					Name:  "region",
+					Usage: "prefer games from `REGION` with --1g1r. May be repeated, best first",
+				},
 				cli.BoolFlag{
 					Name:  "verbose, v",
 					Usage: "increase verbosity",
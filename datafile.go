@@ -0,0 +1,675 @@
+package rombo
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Format is a datafile format
+type Format int
+
+const (
+	statusBadDump = "baddump" // Dumped but known to be bad
+	statusNoDump  = "nodump"  // Known to exist but never dumped
+)
+
+const (
+	Logiqx       Format = iota // Logiqx XML
+	ClrMamePro                 // ClrMamePro text
+	RomCenter                  // RomCenter 2.x ini-style
+	SoftwareList               // MAME software list XML
+)
+
+type ROM struct {
+	Game     string
+	Filename string
+	Size     uint64
+	CRC      string
+	MD5      string
+	SHA1     string
+	CloneOf  string // Parent of the game, if it's a clone
+	Parent   string // Top-level parent following any chain of clones, or the game itself
+	RomOf    string // Parent or BIOS set the game takes ROMs from
+	Merge    string // Name of the same ROM in the parent or BIOS set
+	Disk     bool   // A CHD disk image, only the SHA1 is known
+	Status   string // Dump status, such as baddump or nodump
+
+	SoftwareList string // MAME software list the game belongs to, if any
+}
+
+type datClrMamePro struct {
+	Header       string `xml:"header,attr,omitempty"`
+	ForceMerging string `xml:"forcemerging,attr,omitempty"`
+	ForceNodump  string `xml:"forcenodump,attr,omitempty"`
+	ForcePacking string `xml:"forcepacking,attr,omitempty"`
+}
+
+type datHeader struct {
+	Name        string         `xml:"name"`
+	Description string         `xml:"description"`
+	Category    string         `xml:"category,omitempty"`
+	Version     string         `xml:"version"`
+	Date        string         `xml:"date,omitempty"`
+	Author      string         `xml:"author"`
+	Email       string         `xml:"email,omitempty"`
+	Homepage    string         `xml:"homepage,omitempty"`
+	URL         string         `xml:"url,omitempty"`
+	Comment     string         `xml:"comment,omitempty"`
+	ClrMamePro  *datClrMamePro `xml:"clrmamepro"`
+}
+
+type datROM struct {
+	Name   string `xml:"name,attr"`
+	Size   uint64 `xml:"size,attr"`
+	CRC    string `xml:"crc,attr,omitempty"`
+	MD5    string `xml:"md5,attr,omitempty"`
+	SHA1   string `xml:"sha1,attr,omitempty"`
+	Merge  string `xml:"merge,attr,omitempty"`
+	Status string `xml:"status,attr,omitempty"`
+	Date   string `xml:"date,attr,omitempty"`
+
+	seen bool
+}
+
+type datDisk struct {
+	Name   string `xml:"name,attr"`
+	SHA1   string `xml:"sha1,attr,omitempty"`
+	MD5    string `xml:"md5,attr,omitempty"`
+	Merge  string `xml:"merge,attr,omitempty"`
+	Status string `xml:"status,attr,omitempty"`
+
+	seen bool
+}
+
+// satisfied reports whether the ROM has been found, a ROM that has never
+// been dumped is satisfied by its absence
+func (r *datROM) satisfied() bool {
+	return r.seen || r.Status == statusNoDump
+}
+
+// satisfied reports whether the disk has been found or has never been
+// dumped
+func (d *datDisk) satisfied() bool {
+	return d.seen || d.Status == statusNoDump
+}
+
+// filename is the name of the CHD file holding the disk
+func (d *datDisk) filename() string {
+	return d.Name + chdExtension
+}
+
+type datGame struct {
+	Name         string     `xml:"name,attr"`
+	ID           string     `xml:"id,attr,omitempty"`
+	SourceFile   string     `xml:"sourcefile,attr,omitempty"`
+	IsBIOS       string     `xml:"isbios,attr,omitempty"`
+	CloneOf      string     `xml:"cloneof,attr,omitempty"`
+	CloneOfID    string     `xml:"cloneofid,attr,omitempty"`
+	RomOf        string     `xml:"romof,attr,omitempty"`
+	SampleOf     string     `xml:"sampleof,attr,omitempty"`
+	Board        string     `xml:"board,attr,omitempty"`
+	Comment      []string   `xml:"comment,omitempty"`
+	Description  string     `xml:"description"`
+	Year         string     `xml:"year,omitempty"`
+	Manufacturer string     `xml:"manufacturer,omitempty"`
+	ROMs         []*datROM  `xml:"rom"`
+	Disks        []*datDisk `xml:"disk"`
+
+	// Not part of Logiqx, it keeps the software list a game came from
+	// when the datafile is written back out as XML
+	SoftwareList string `xml:"softwarelist,attr,omitempty"`
+}
+
+type datDocument struct {
+	XMLName xml.Name   `xml:"datafile"`
+	Header  *datHeader `xml:"header"`
+	Games   []*datGame `xml:"game"`
+}
+
+type romKey struct {
+	size uint64
+	hash string
+}
+
+type romName struct {
+	game string
+	rom  string
+}
+
+type romRef struct {
+	game *datGame
+	rom  *datROM
+}
+
+type diskRef struct {
+	game *datGame
+	disk *datDisk
+}
+
+type Datafile struct {
+	format  Format
+	header  *datHeader
+	games   []*datGame
+	crc     map[romKey][]romRef
+	md5     map[romKey][]romRef
+	sha1    map[romKey][]romRef
+	names   map[romName][]*datROM
+	disks   map[string][]diskRef
+	dnames  map[romName][]*datDisk
+	parents map[string]string
+	sets    map[string]*datGame
+	groups  map[string][]*datGame
+	mutex   sync.RWMutex
+}
+
+func latin1ToUTF8(b []byte) []byte {
+	// Each byte maps directly to the same Unicode code point
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return []byte(string(runes))
+}
+
+func detectFormat(b []byte) (Format, error) {
+	b = bytes.TrimPrefix(b, []byte("\xef\xbb\xbf"))
+	b = bytes.TrimLeft(b, " \t\r\n")
+
+	switch {
+	case bytes.HasPrefix(b, []byte("<")):
+		root, err := xmlRoot(b)
+		if err != nil {
+			return 0, err
+		}
+		if root == "softwarelist" {
+			return SoftwareList, nil
+		}
+		return Logiqx, nil
+	case bytes.HasPrefix(b, []byte("clrmamepro")), bytes.HasPrefix(b, []byte("game")), bytes.HasPrefix(b, []byte("resource")):
+		return ClrMamePro, nil
+	case bytes.HasPrefix(b, []byte("[")):
+		return RomCenter, nil
+	default:
+		return 0, errors.New("unknown datafile format")
+	}
+}
+
+func parseDatafile(b []byte) (*datDocument, Format, error) {
+	format, err := detectFormat(b)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var document *datDocument
+
+	switch format {
+	case Logiqx:
+		document, err = xmlParse(b)
+	case ClrMamePro:
+		document, err = cmpParse(b)
+	case RomCenter:
+		document, err = rcParse(b)
+	case SoftwareList:
+		document, err = slParse(b)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(document.Games) == 0 {
+		return nil, 0, errors.New("no games found in datafile")
+	}
+
+	normalizeGames(document.Games)
+	resolveCloneIDs(document.Games)
+
+	return document, format, nil
+}
+
+func normalizeGames(games []*datGame) {
+	for _, game := range games {
+		for _, rom := range game.ROMs {
+			rom.CRC = strings.ToLower(rom.CRC)
+			rom.MD5 = strings.ToLower(rom.MD5)
+			rom.SHA1 = strings.ToLower(rom.SHA1)
+		}
+		for _, disk := range game.Disks {
+			disk.MD5 = strings.ToLower(disk.MD5)
+			disk.SHA1 = strings.ToLower(disk.SHA1)
+		}
+	}
+}
+
+func NewDatafile(b []byte) (*Datafile, error) {
+	document, format, err := parseDatafile(b)
+	if err != nil {
+		return nil, err
+	}
+
+	d := Datafile{
+		format: format,
+		header: document.Header,
+		games:  document.Games,
+	}
+	d.reindex()
+
+	return &d, nil
+}
+
+// NewEmptyDatafile returns a Logiqx datafile without any games
+func NewEmptyDatafile() *Datafile {
+	d := Datafile{
+		format: Logiqx,
+		header: &datHeader{},
+	}
+	d.reindex()
+
+	return &d
+}
+
+// reindex rebuilds the indexes from scratch for the current games, the
+// caller is expected to hold the write lock if required
+func (d *Datafile) reindex() {
+	d.crc = make(map[romKey][]romRef)
+	d.md5 = make(map[romKey][]romRef)
+	d.sha1 = make(map[romKey][]romRef)
+	d.names = make(map[romName][]*datROM)
+	d.disks = make(map[string][]diskRef)
+	d.dnames = make(map[romName][]*datDisk)
+	d.parents = make(map[string]string)
+	d.sets = make(map[string]*datGame, len(d.games))
+	d.groups = make(map[string][]*datGame)
+
+	for _, game := range d.games {
+		d.sets[game.Name] = game
+	}
+
+	for _, game := range d.games {
+		// A parent that isn't in the datafile is ignored
+		if game.CloneOf != "" && d.sets[game.CloneOf] != nil {
+			d.parents[game.Name] = game.CloneOf
+		}
+
+		for _, rom := range game.ROMs {
+			// There's nothing to find for a ROM that has never been
+			// dumped so it isn't indexed
+			if rom.Status == statusNoDump {
+				continue
+			}
+
+			// Index by the exact game and ROM name, no escaping or
+			// quoting is involved so any legal name is matched
+			name := romName{game.Name, rom.Name}
+			d.names[name] = append(d.names[name], rom)
+
+			ref := romRef{game, rom}
+			if rom.CRC != "" {
+				key := romKey{rom.Size, rom.CRC}
+				d.crc[key] = append(d.crc[key], ref)
+			}
+			if rom.MD5 != "" {
+				key := romKey{rom.Size, rom.MD5}
+				d.md5[key] = append(d.md5[key], ref)
+			}
+			if rom.SHA1 != "" {
+				key := romKey{rom.Size, rom.SHA1}
+				d.sha1[key] = append(d.sha1[key], ref)
+			}
+		}
+
+		for _, disk := range game.Disks {
+			if disk.Status == statusNoDump {
+				continue
+			}
+
+			name := romName{game.Name, disk.filename()}
+			d.dnames[name] = append(d.dnames[name], disk)
+
+			if disk.SHA1 != "" {
+				d.disks[disk.SHA1] = append(d.disks[disk.SHA1], diskRef{game, disk})
+			}
+		}
+	}
+
+	for _, game := range d.games {
+		parent := d.parentLocked(game.Name)
+		d.groups[parent] = append(d.groups[parent], game)
+	}
+}
+
+// Format returns the format the datafile was originally read in
+func (d *Datafile) Format() Format {
+	return d.format
+}
+
+// headerName returns the name of the ClrMamePro header detector the
+// datafile references, if any
+func (d *Datafile) headerName() string {
+	if d.header == nil || d.header.ClrMamePro == nil {
+		return ""
+	}
+	return d.header.ClrMamePro.Header
+}
+
+// remaining returns a copy of the datafile containing only the ROMs that
+// haven't been satisfied, the caller is expected to hold the read lock
+func (d *Datafile) remaining() *datDocument {
+	document := datDocument{
+		Header: d.header,
+		Games:  make([]*datGame, 0, len(d.games)),
+	}
+
+	for _, game := range d.games {
+		roms := make([]*datROM, 0, len(game.ROMs))
+		for _, rom := range game.ROMs {
+			if !rom.satisfied() {
+				roms = append(roms, rom)
+			}
+		}
+
+		disks := make([]*datDisk, 0, len(game.Disks))
+		for _, disk := range game.Disks {
+			if !disk.satisfied() {
+				disks = append(disks, disk)
+			}
+		}
+
+		if len(roms) == 0 && len(disks) == 0 {
+			continue
+		}
+
+		g := *game
+		g.ROMs = roms
+		g.Disks = disks
+		document.Games = append(document.Games, &g)
+	}
+
+	return &document
+}
+
+// Marshal returns the whole datafile as Logiqx XML regardless of which ROMs
+// have been found, use Fixdat for only those that are missing
+func (d *Datafile) Marshal() []byte {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	return xmlMarshal(&datDocument{
+		Header: d.header,
+		Games:  d.games,
+	})
+}
+
+func marshalDocument(document *datDocument, format Format) ([]byte, error) {
+	switch format {
+	case Logiqx:
+		return xmlMarshal(document), nil
+	case ClrMamePro:
+		return cmpMarshal(document), nil
+	case RomCenter:
+		return rcMarshal(document), nil
+	case SoftwareList:
+		return nil, errors.New("software lists can only be written as Logiqx XML")
+	default:
+		return nil, fmt.Errorf("unknown datafile format: %d", format)
+	}
+}
+
+// mergeable reports whether a ROM or disk with the merge attribute is
+// really stored in the parent or BIOS set, which must be in the datafile
+func (d *Datafile) mergeable(cloneOf, romOf, merge string) bool {
+	set := romOf
+	if set == "" {
+		set = cloneOf
+	}
+	return merge != "" && d.sets[set] != nil
+}
+
+// detached removes any reference to a parent or BIOS set that isn't in the
+// datafile so the ROM is stored in its own set instead
+func (d *Datafile) detached(rom ROM) ROM {
+	if !d.mergeable(rom.CloneOf, rom.RomOf, rom.Merge) {
+		rom.Merge = ""
+	}
+	if d.sets[rom.CloneOf] == nil {
+		rom.CloneOf = ""
+	}
+	if d.sets[rom.RomOf] == nil {
+		rom.RomOf = ""
+	}
+	return rom
+}
+
+func (d *Datafile) newROM(game *datGame, rom *datROM) ROM {
+	return d.detached(ROM{
+		Game:     game.Name,
+		Filename: rom.Name,
+		Size:     rom.Size,
+		CRC:      rom.CRC,
+		MD5:      rom.MD5,
+		SHA1:     rom.SHA1,
+		CloneOf:  game.CloneOf,
+		Parent:   d.parentLocked(game.Name),
+		RomOf:    game.RomOf,
+		Merge:    rom.Merge,
+		Status:   rom.Status,
+
+		SoftwareList: game.SoftwareList,
+	})
+}
+
+// parent returns the top-level parent of the game, following any chain of
+// clones
+func (d *Datafile) parent(game string) string {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	return d.parentLocked(game)
+}
+
+// parentLocked is parent for callers already holding the lock
+func (d *Datafile) parentLocked(game string) string {
+	seen := make(map[string]bool)
+	for !seen[game] {
+		seen[game] = true
+
+		parent, ok := d.parents[game]
+		if !ok {
+			break
+		}
+		game = parent
+	}
+
+	return game
+}
+
+func (d *Datafile) newDiskROM(game *datGame, disk *datDisk) ROM {
+	return d.detached(ROM{
+		Game:     game.Name,
+		Filename: disk.filename(),
+		MD5:      disk.MD5,
+		SHA1:     disk.SHA1,
+		CloneOf:  game.CloneOf,
+		Parent:   d.parentLocked(game.Name),
+		RomOf:    game.RomOf,
+		Merge:    disk.Merge,
+		Disk:     true,
+		Status:   disk.Status,
+
+		SoftwareList: game.SoftwareList,
+	})
+}
+
+func (d *Datafile) findROM(index map[romKey][]romRef, size uint64, hash string) ([]ROM, bool, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	refs := index[romKey{size, strings.ToLower(hash)}]
+	if len(refs) == 0 {
+		return nil, false, nil
+	}
+
+	roms := make([]ROM, 0, len(refs))
+	for _, ref := range refs {
+		roms = append(roms, d.newROM(ref.game, ref.rom))
+	}
+
+	return roms, true, nil
+}
+
+func (d *Datafile) findROMByCRC(size uint64, crc string) ([]ROM, bool, error) {
+	return d.findROM(d.crc, size, crc)
+}
+
+// findROMByChecksums finds any ROM matching the given checksums, each ROM
+// is matched using the strongest hash present in the datafile for that ROM,
+// so a ROM with a SHA1 is never matched just on its CRC
+func (d *Datafile) findROMByChecksums(size uint64, crc, md5, sha string) ([]ROM, bool, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	var roms []ROM
+
+	for _, ref := range d.sha1[romKey{size, strings.ToLower(sha)}] {
+		roms = append(roms, d.newROM(ref.game, ref.rom))
+	}
+
+	for _, ref := range d.md5[romKey{size, strings.ToLower(md5)}] {
+		if ref.rom.SHA1 == "" {
+			roms = append(roms, d.newROM(ref.game, ref.rom))
+		}
+	}
+
+	for _, ref := range d.crc[romKey{size, strings.ToLower(crc)}] {
+		if ref.rom.SHA1 == "" && ref.rom.MD5 == "" {
+			roms = append(roms, d.newROM(ref.game, ref.rom))
+		}
+	}
+
+	return roms, len(roms) > 0, nil
+}
+
+// findDisk finds any disk with the given SHA1
+func (d *Datafile) findDisk(sha string) ([]ROM, bool, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	refs := d.disks[strings.ToLower(sha)]
+	if len(refs) == 0 {
+		return nil, false, nil
+	}
+
+	roms := make([]ROM, 0, len(refs))
+	for _, ref := range refs {
+		roms = append(roms, d.newDiskROM(ref.game, ref.disk))
+	}
+
+	return roms, true, nil
+}
+
+func (d *Datafile) seenDisk(rom ROM) error {
+	var matched *datDisk
+	for _, disk := range d.dnames[romName{rom.Game, rom.Filename}] {
+		if disk.seen {
+			continue
+		}
+		if matched != nil {
+			return errors.New("more than one matched disk")
+		}
+		matched = disk
+	}
+
+	if matched != nil {
+		matched.seen = true
+	}
+
+	return nil
+}
+
+func (d *Datafile) seenROM(rom ROM) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if rom.Disk {
+		return d.seenDisk(rom)
+	}
+
+	var matched *datROM
+	for _, r := range d.names[romName{rom.Game, rom.Filename}] {
+		if r.seen {
+			continue
+		}
+		if matched != nil {
+			return errors.New("more than one matched ROM")
+		}
+		matched = r
+	}
+
+	if matched != nil {
+		matched.seen = true
+	}
+
+	return nil
+}
+
+func (d *Datafile) GamesRemaining() (int, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	games := 0
+Game:
+	for _, game := range d.games {
+		for _, rom := range game.ROMs {
+			if !rom.satisfied() {
+				games++
+				continue Game
+			}
+		}
+		for _, disk := range game.Disks {
+			if !disk.satisfied() {
+				games++
+				continue Game
+			}
+		}
+	}
+
+	return games, nil
+}
+
+// withStatus returns every ROM and disk with the given dump status, if seen
+// is true only those that have been found are returned
+func (d *Datafile) withStatus(status string, seen bool) []ROM {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	var roms []ROM
+	for _, game := range d.games {
+		for _, rom := range game.ROMs {
+			if rom.Status == status && (rom.seen || !seen) {
+				roms = append(roms, d.newROM(game, rom))
+			}
+		}
+		for _, disk := range game.Disks {
+			if disk.Status == status && (disk.seen || !seen) {
+				roms = append(roms, d.newDiskROM(game, disk))
+			}
+		}
+	}
+
+	return roms
+}
+
+// NoDumps returns every ROM and disk that is known to exist but has never
+// been dumped. These are always considered present
+func (d *Datafile) NoDumps() []ROM {
+	return d.withStatus(statusNoDump, false)
+}
+
+// BadDumps returns every ROM and disk that has been found but is known to
+// be a bad dump
+func (d *Datafile) BadDumps() []ROM {
+	return d.withStatus(statusBadDump, true)
+}
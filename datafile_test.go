@@ -0,0 +1,293 @@
+package rombo
+
+import (
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Awkward names from real No-Intro and Redump dat files
+var awkwardNames = []struct {
+	game string
+	rom  string
+}{
+	{`Sam & Max Hit the Road (USA)`, `Sam & Max Hit the Road (USA).bin`},
+	{`Pac-Man 2 - The New Adventures (USA)`, `Pac-Man 2 - The New Adventures (USA).sfc`},
+	{`Tom Clancy's Rainbow Six (USA)`, `Tom Clancy's Rainbow Six (USA).z64`},
+	{`"Just Dance" Demo (Europe)`, `"Just Dance" Demo (Europe).iso`},
+	{`Jeopardy! "Sports Edition" - Tom's Choice (USA)`, `Jeopardy! "Sports Edition" - Tom's Choice (USA).nes`},
+	{`<Untitled> Prototype (USA) (Proto)`, `<Untitled> Prototype (USA) (Proto).gba`},
+	{`Pokémon - Version Rouge (France)`, `Pokémon - Version Rouge (France).gb`},
+	{`ドラゴンクエスト (Japan)`, `ドラゴンクエスト (Japan).nes`},
+	{`Beyblade - Let It Rip! (USA) [b]`, `Beyblade - Let It Rip! (USA) [b].gba`},
+}
+
+// awkwardDatafile is written out by hand so the entity escaping matches
+// what real dat files contain
+const awkwardDatafile = `<?xml version="1.0"?>
+<!DOCTYPE datafile PUBLIC "-//Logiqx//DTD ROM Management Datafile//EN" "http://www.logiqx.com/Dats/datafile.dtd">
+<datafile>
+	<header>
+		<name>Awkward</name>
+	</header>
+	<game name="Sam &amp; Max Hit the Road (USA)">
+		<description>Sam &amp; Max Hit the Road (USA)</description>
+		<rom name="Sam &amp; Max Hit the Road (USA).bin" size="1" crc="00000000"/>
+	</game>
+	<game name="Pac-Man 2 - The New Adventures (USA)">
+		<description>Pac-Man 2 - The New Adventures (USA)</description>
+		<rom name="Pac-Man 2 - The New Adventures (USA).sfc" size="2" crc="00000000"/>
+	</game>
+	<game name="Tom Clancy's Rainbow Six (USA)">
+		<description>Tom Clancy's Rainbow Six (USA)</description>
+		<rom name="Tom Clancy&apos;s Rainbow Six (USA).z64" size="3" crc="00000000"/>
+	</game>
+	<game name="&quot;Just Dance&quot; Demo (Europe)">
+		<description>"Just Dance" Demo (Europe)</description>
+		<rom name="&quot;Just Dance&quot; Demo (Europe).iso" size="4" crc="00000000"/>
+	</game>
+	<game name='Jeopardy! "Sports Edition" - Tom&apos;s Choice (USA)'>
+		<description>Jeopardy! "Sports Edition" - Tom's Choice (USA)</description>
+		<rom name="Jeopardy! &quot;Sports Edition&quot; - Tom's Choice (USA).nes" size="5" crc="00000000"/>
+	</game>
+	<game name="&lt;Untitled&gt; Prototype (USA) (Proto)">
+		<description>&lt;Untitled&gt; Prototype (USA) (Proto)</description>
+		<rom name="&lt;Untitled&gt; Prototype (USA) (Proto).gba" size="6" crc="00000000"/>
+	</game>
+	<game name="Pokémon - Version Rouge (France)">
+		<description>Pokémon - Version Rouge (France)</description>
+		<rom name="Pok&#233;mon - Version Rouge (France).gb" size="7" crc="00000000"/>
+	</game>
+	<game name="ドラゴンクエスト (Japan)">
+		<description>ドラゴンクエスト (Japan)</description>
+		<rom name="ドラゴンクエスト (Japan).nes" size="8" crc="00000000"/>
+	</game>
+	<game name="Beyblade - Let It Rip! (USA) [b]">
+		<description>Beyblade - Let It Rip! (USA) [b]</description>
+		<rom name="Beyblade - Let It Rip! (USA) [b].gba" size="9" crc="00000000"/>
+	</game>
+</datafile>
+`
+
+func TestSeenROMAwkwardNames(t *testing.T) {
+	for i, tt := range awkwardNames {
+		t.Run(tt.game, func(t *testing.T) {
+			d, err := NewDatafile([]byte(awkwardDatafile))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := d.seenROM(ROM{Game: tt.game, Filename: tt.rom, Size: uint64(i + 1)}); err != nil {
+				t.Fatal(err)
+			}
+
+			for j, game := range d.games {
+				if game.ROMs[0].seen != (i == j) {
+					t.Errorf("ROM %q in %q seen: %t", game.ROMs[0].Name, game.Name, game.ROMs[0].seen)
+				}
+			}
+
+			games, err := d.GamesRemaining()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if games != len(awkwardNames)-1 {
+				t.Errorf("got %d games remaining, want %d", games, len(awkwardNames)-1)
+			}
+		})
+	}
+}
+
+func TestMarshalAwkwardNames(t *testing.T) {
+	d, err := NewDatafile([]byte(awkwardDatafile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := d.Marshal()
+
+	document := datDocument{}
+	if err := xml.NewDecoder(strings.NewReader(string(b))).Decode(&document); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(document.Games) != len(awkwardNames) {
+		t.Fatalf("got %d games, want %d", len(document.Games), len(awkwardNames))
+	}
+
+	for i, tt := range awkwardNames {
+		game := document.Games[i]
+		if game.Name != tt.game {
+			t.Errorf("got game %q, want %q", game.Name, tt.game)
+		}
+		if len(game.ROMs) != 1 || game.ROMs[0].Name != tt.rom {
+			t.Errorf("got ROMs %v in %q, want %q", game.ROMs, game.Name, tt.rom)
+		}
+	}
+}
+
+func TestNewDatafileRoot(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		games int
+	}{
+		{"game", `<datafile><game name="a"><rom name="a" size="1"/></game></datafile>`, 1},
+		{"machine", `<datafile><machine name="a"><rom name="a" size="1"/></machine><machine name="b"/></datafile>`, 2},
+		{"mame", `<mame build="0.250"><machine name="a"><rom name="a" size="1"/></machine></mame>`, 1},
+		{"empty", `<datafile><header><name>a</name></header></datafile>`, 0},
+		{"unknown", `<other><game name="a"/></other>`, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := NewDatafile([]byte(tt.input))
+			if tt.games == 0 {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(d.games) != tt.games {
+				t.Errorf("got %d games, want %d", len(d.games), tt.games)
+			}
+		})
+	}
+}
+
+const nodumpDatafile = `<datafile>
+	<header>
+		<name>Dumps</name>
+	</header>
+	<game name="a">
+		<description>A</description>
+		<rom name="a.rom" size="1" crc="00000001"/>
+		<rom name="b.rom" size="1" status="nodump"/>
+		<disk name="c" status="nodump"/>
+	</game>
+	<game name="b">
+		<description>B</description>
+		<rom name="d.rom" size="1" status="nodump"/>
+	</game>
+	<game name="c">
+		<description>C</description>
+		<rom name="e.rom" size="1" crc="00000002"/>
+	</game>
+</datafile>`
+
+func TestNoDump(t *testing.T) {
+	d, err := NewDatafile([]byte(nodumpDatafile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.seenROM(ROM{Game: "a", Filename: "a.rom", Size: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	games, err := d.GamesRemaining()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if games != 1 {
+		t.Errorf("got %d games remaining, want 1", games)
+	}
+
+	if n := len(d.NoDumps()); n != 3 {
+		t.Errorf("got %d nodumps, want 3", n)
+	}
+
+	// Marshal writes everything regardless of what has been found
+	other, err := NewDatafile(d.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gameNames(other), []string{"a", "b", "c"}) {
+		t.Errorf("marshalled games %v", gameNames(other))
+	}
+	if len(other.games[0].ROMs) != 2 || len(other.games[0].Disks) != 1 {
+		t.Errorf("marshalled game a has %d ROMs and %d disks", len(other.games[0].ROMs), len(other.games[0].Disks))
+	}
+
+	// A fixdat only lists what is still missing
+	b, err := d.Fixdat(Logiqx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixdat, err := NewDatafile(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gameNames(fixdat), []string{"c"}) {
+		t.Errorf("fixdat games %v", gameNames(fixdat))
+	}
+}
+
+func gameNames(d *Datafile) []string {
+	names := make([]string, 0, len(d.games))
+	for _, game := range d.games {
+		names = append(names, game.Name)
+	}
+	return names
+}
+
+const strongestHashDatafile = `<?xml version="1.0"?>
+<datafile>
+	<header><name>Hashes</name></header>
+	<game name="SHA1"><description>SHA1</description><rom name="a.rom" size="3" crc="352441c2" md5="900150983cd24fb0d6963f7d28e17f72" sha1="a9993e364706816aba3e25717850c26c9cd0d89d"/></game>
+	<game name="MD5"><description>MD5</description><rom name="b.rom" size="3" crc="352441c2" md5="900150983cd24fb0d6963f7d28e17f72"/></game>
+	<game name="CRC"><description>CRC</description><rom name="c.rom" size="3" crc="352441C2"/></game>
+</datafile>`
+
+func TestFindROMByChecksums(t *testing.T) {
+	d, err := NewDatafile([]byte(strongestHashDatafile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		crc  = "352441c2"
+		md5  = "900150983cd24fb0d6963f7d28e17f72"
+		sha  = "a9993e364706816aba3e25717850c26c9cd0d89d"
+		none = "0"
+	)
+
+	tests := []struct {
+		name           string
+		size           uint64
+		crc, md5, sha1 string
+		want           []string
+	}{
+		{"all match", 3, crc, md5, sha, []string{"SHA1", "MD5", "CRC"}},
+		{"uppercase", 3, strings.ToUpper(crc), strings.ToUpper(md5), strings.ToUpper(sha), []string{"SHA1", "MD5", "CRC"}},
+		{"wrong sha1", 3, crc, md5, none, []string{"MD5", "CRC"}},
+		{"wrong md5", 3, crc, none, sha, []string{"SHA1", "CRC"}},
+		{"only crc", 3, crc, none, none, []string{"CRC"}},
+		{"wrong crc", 3, none, md5, sha, []string{"SHA1", "MD5"}},
+		{"wrong size", 4, crc, md5, sha, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			roms, ok, err := d.findROMByChecksums(tt.size, tt.crc, tt.md5, tt.sha1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != (len(tt.want) > 0) {
+				t.Errorf("got found %v with %d roms", ok, len(roms))
+			}
+
+			var got []string
+			for _, rom := range roms {
+				got = append(got, rom.Game)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
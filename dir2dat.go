@@ -0,0 +1,264 @@
+package rombo
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// datBuilder collects the games found by Dir2Dat from concurrent workers
+type datBuilder struct {
+	games   map[string]*datGame
+	sources map[string]string
+	mutex   sync.Mutex
+}
+
+// game returns the game with the given name, creating it if necessary. Each
+// game can only come from one source, either an archive or a directory of
+// loose files, so foo.zip, foo.7z and a directory foo can't silently become
+// one game
+func (b *datBuilder) game(name, source string) (*datGame, error) {
+	game, ok := b.games[name]
+	if !ok {
+		game = &datGame{
+			Name:        name,
+			Description: name,
+		}
+		b.games[name] = game
+		b.sources[name] = source
+	}
+
+	if b.sources[name] != source {
+		return nil, fmt.Errorf("game %s found in both %s and %s", name, b.sources[name], source)
+	}
+
+	return game, nil
+}
+
+func (b *datBuilder) addROM(game, source string, rom *datROM) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	g, err := b.game(game, source)
+	if err != nil {
+		return err
+	}
+	g.ROMs = append(g.ROMs, rom)
+
+	return nil
+}
+
+func (b *datBuilder) addDisk(game, source string, disk *datDisk) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	g, err := b.game(game, source)
+	if err != nil {
+		return err
+	}
+	g.Disks = append(g.Disks, disk)
+
+	return nil
+}
+
+// sorted returns the games, and their ROMs and disks, sorted by name so the
+// output doesn't depend on the order the workers finished in
+func (b *datBuilder) sorted() []*datGame {
+	games := make([]*datGame, 0, len(b.games))
+	for _, game := range b.games {
+		sort.Slice(game.ROMs, func(i, j int) bool {
+			return game.ROMs[i].Name < game.ROMs[j].Name
+		})
+		sort.Slice(game.Disks, func(i, j int) bool {
+			return game.Disks[i].Name < game.Disks[j].Name
+		})
+		games = append(games, game)
+	}
+
+	sort.Slice(games, func(i, j int) bool {
+		return games[i].Name < games[j].Name
+	})
+
+	return games
+}
+
+// dir2datName returns the game name for path within the base directory,
+// using forward slashes regardless of the platform
+func dir2datName(base, path string) (string, error) {
+	relpath, err := filepath.Rel(base, path)
+	if err != nil {
+		return "", err
+	}
+
+	if relpath == "." {
+		abs, err := filepath.Abs(base)
+		if err != nil {
+			return "", err
+		}
+		relpath = filepath.Base(abs)
+	}
+
+	return filepath.ToSlash(relpath), nil
+}
+
+// archiveGameName strips the archive extension, including the .tar of a
+// compressed tarball
+func archiveGameName(name string) string {
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	return strings.TrimSuffix(name, ".tar")
+}
+
+// dir2datFileWorker is like fileWorker but only checksums each file, there
+// is no datafile to look anything up in
+func (r *Rombo) dir2datFileWorker(ctx context.Context, dir string, b *datBuilder, in <-chan string) (<-chan error, error) {
+	errc := make(chan error, 1)
+	go func() {
+		defer close(errc)
+		for file := range in {
+			sum, err := r.checksumFile(file)
+			if err != nil {
+				errc <- err
+				return
+			}
+
+			r.logger.Printf("Working on file \"%s\" with SHA1 %s\n", file, sum.sha1)
+
+			if err := b.addFile(dir, file, sum); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+	return errc, nil
+}
+
+// addFile adds a loose file to the game for the directory it is in
+func (b *datBuilder) addFile(dir, file string, sum checksum) error {
+	game, err := dir2datName(dir, filepath.Dir(file))
+	if err != nil {
+		return err
+	}
+
+	name := filepath.Base(file)
+
+	if sum.disk {
+		return b.addDisk(game, filepath.Dir(file), &datDisk{
+			Name: strings.TrimSuffix(name, chdExtension),
+			SHA1: sum.sha1,
+		})
+	}
+
+	return b.addROM(game, filepath.Dir(file), &datROM{
+		Name: name,
+		Size: sum.size,
+		CRC:  sum.crc,
+		MD5:  sum.md5,
+		SHA1: sum.sha1,
+	})
+}
+
+func (r *Rombo) dir2datArchive(b *datBuilder) func(context.Context, string, string) error {
+	return func(ctx context.Context, dir, file string) error {
+		game, err := dir2datName(dir, file)
+		if err != nil {
+			return err
+		}
+		game = archiveGameName(game)
+
+		reader, closer, err := openArchive(file, r.cache)
+		if err != nil {
+			return err
+		}
+		defer closer.Close()
+
+		// Nested archives are described as they are rather than by
+		// their contents
+		err = walkArchive(reader, 0, func(path memberPath, f archiveFile) error {
+			sum, err := r.checksumArchiveFile(file, path, f, nil)
+			if err != nil {
+				return err
+			}
+
+			return b.addROM(game, file, &datROM{
+				Name: path.String(),
+				Size: sum.size,
+				CRC:  sum.crc,
+				MD5:  sum.md5,
+				SHA1: sum.sha1,
+			})
+		})
+		if err != nil {
+			return err
+		}
+
+		return closer.Close()
+	}
+}
+
+// Dir2Dat replaces the games in the datafile with the contents of each
+// directory. Every archive becomes a game named after its path, without the
+// extension, and loose files are grouped into a game for the directory they
+// are in. It's an error for more than one archive or directory to have the
+// same game name
+func (r *Rombo) Dir2Dat(dirs []string) error {
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	b := datBuilder{
+		games:   make(map[string]*datGame),
+		sources: make(map[string]string),
+	}
+
+	// Game names are relative to each directory so each one is walked
+	// separately
+	for _, dir := range dirs {
+		var errcList []<-chan error
+
+		findc, errc, err := r.findFiles(ctx, dir)
+		if err != nil {
+			return err
+		}
+		errcList = append(errcList, errc)
+
+		filec, archivec, errc, err := r.mimeSplitter(ctx, findc)
+		if err != nil {
+			return err
+		}
+		errcList = append(errcList, errc)
+
+		for i := 0; i < 10; i++ {
+			errc, err := r.dir2datFileWorker(ctx, dir, &b, filec)
+			if err != nil {
+				return err
+			}
+			errcList = append(errcList, errc)
+
+			errc, err = r.archiveWorker(ctx, dir, r.dir2datArchive(&b), archivec)
+			if err != nil {
+				return err
+			}
+			errcList = append(errcList, errc)
+		}
+
+		if err := waitForPipeline(errcList...); err != nil {
+			return err
+		}
+	}
+
+	r.datafile.mutex.Lock()
+	defer r.datafile.mutex.Unlock()
+
+	if r.datafile.header == nil {
+		r.datafile.header = &datHeader{}
+	}
+	r.datafile.header.Date = time.Now().Format("2006-01-02")
+
+	r.datafile.games = b.sorted()
+	r.datafile.reindex()
+
+	return nil
+}
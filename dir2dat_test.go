@@ -0,0 +1,169 @@
+package rombo
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeDir2DatZip(t *testing.T, file, name string, b []byte) {
+	t.Helper()
+
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	w := zip.NewWriter(f)
+	zf, err := w.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := zf.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeDir2DatTarGz(t *testing.T, file, name string, b []byte) {
+	t.Helper()
+
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(b))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDir2Dat(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(*testing.T, string)
+		games []string
+	}{
+		{
+			"distinct",
+			func(t *testing.T, dir string) {
+				writeDir2DatZip(t, filepath.Join(dir, "foo.zip"), "a.rom", []byte("foo"))
+				writeDir2DatTarGz(t, filepath.Join(dir, "bar.tar.gz"), "b.rom", []byte("bar"))
+				if err := os.Mkdir(filepath.Join(dir, "baz"), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(filepath.Join(dir, "baz", "c.rom"), []byte("baz"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			[]string{"bar", "baz", "foo"},
+		},
+		{
+			"archives",
+			func(t *testing.T, dir string) {
+				writeDir2DatZip(t, filepath.Join(dir, "foo.zip"), "a.rom", []byte("foo"))
+				writeDir2DatTarGz(t, filepath.Join(dir, "foo.tar.gz"), "b.rom", []byte("bar"))
+			},
+			nil,
+		},
+		{
+			"archive and directory",
+			func(t *testing.T, dir string) {
+				writeDir2DatZip(t, filepath.Join(dir, "foo.zip"), "a.rom", []byte("foo"))
+				if err := os.Mkdir(filepath.Join(dir, "foo"), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(filepath.Join(dir, "foo", "c.rom"), []byte("baz"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			tt.setup(t, dir)
+
+			d := NewEmptyDatafile()
+			r, err := New(d, log.New(ioutil.Discard, "", 0), false, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = r.Dir2Dat([]string{dir})
+			if tt.games == nil {
+				if err == nil {
+					t.Errorf("expected an error, got games %v", gameNames(d))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := gameNames(d); !reflect.DeepEqual(got, tt.games) {
+				t.Errorf("got games %v, want %v", got, tt.games)
+			}
+		})
+	}
+}
+
+func TestDir2DatChecksums(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "foo"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "foo", "a.rom"), []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewEmptyDatafile()
+	r, err := New(d, log.New(ioutil.Discard, "", 0), false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Dir2Dat([]string{dir}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []*datROM{
+		{
+			Name: "a.rom",
+			Size: 3,
+			CRC:  "352441c2",
+			MD5:  "900150983cd24fb0d6963f7d28e17f72",
+			SHA1: "a9993e364706816aba3e25717850c26c9cd0d89d",
+		},
+	}
+
+	if len(d.games) != 1 || d.games[0].Name != "foo" {
+		t.Fatalf("got games %v, want [foo]", gameNames(d))
+	}
+	if !reflect.DeepEqual(d.games[0].ROMs, want) {
+		t.Errorf("got ROMs %+v, want %+v", d.games[0].ROMs, want)
+	}
+}
@@ -4,8 +4,50 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sync"
 )
 
+type pathLock struct {
+	sync.Mutex
+	refs int
+}
+
+// pathLocks serializes access to individual paths
+type pathLocks struct {
+	mutex sync.Mutex
+	locks map[string]*pathLock
+}
+
+// lock blocks until path is available and returns a function that releases
+// it again
+func (p *pathLocks) lock(path string) func() {
+	p.mutex.Lock()
+	if p.locks == nil {
+		p.locks = make(map[string]*pathLock)
+	}
+	l, ok := p.locks[path]
+	if !ok {
+		l = &pathLock{}
+		p.locks[path] = l
+	}
+	l.refs++
+	p.mutex.Unlock()
+
+	l.Lock()
+
+	return func() {
+		l.Unlock()
+
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+
+		l.refs--
+		if l.refs == 0 {
+			delete(p.locks, path)
+		}
+	}
+}
+
 func copyFile(src, dst string) error {
 	in, err := os.Open(src)
 	if err != nil {
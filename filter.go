@@ -0,0 +1,257 @@
+package rombo
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Regions used in No-Intro and Redump names
+var noIntroRegions = map[string]bool{
+	"argentina": true, "asia": true, "australia": true, "austria": true,
+	"belgium": true, "brazil": true, "canada": true, "china": true,
+	"croatia": true, "denmark": true, "europe": true, "finland": true,
+	"france": true, "germany": true, "greece": true, "hong kong": true,
+	"india": true, "ireland": true, "israel": true, "italy": true,
+	"japan": true, "korea": true, "latin america": true, "mexico": true,
+	"netherlands": true, "new zealand": true, "norway": true,
+	"poland": true, "portugal": true, "russia": true,
+	"scandinavia": true, "south africa": true, "spain": true,
+	"sweden": true, "switzerland": true, "taiwan": true, "turkey": true,
+	"uk": true, "united kingdom": true, "unknown": true, "usa": true,
+	"world": true,
+}
+
+var (
+	noIntroTag      = regexp.MustCompile(`\(([^()]+)\)|\[([^\[\]]+)\]`)
+	noIntroLanguage = regexp.MustCompile(`^[A-Z][a-z](-[A-Z][a-z]+)?$`)
+	noIntroRevision = regexp.MustCompile(`^rev ([0-9a-z.]+)$`)
+)
+
+// Tags for games that were never released in their final form
+var noIntroPrerelease = []string{"beta", "proto", "demo", "sample", "preview", "promo", "kiosk"}
+
+type nameTags struct {
+	regions   []string
+	languages []string
+	flags     []string
+	revision  string
+}
+
+// parseTags splits the No-Intro tags in a game name, such as (USA),
+// (En,Fr), (Beta) and [BIOS], into regions, languages and anything else.
+// Everything is lowercased
+func parseTags(name string) nameTags {
+	tags := nameTags{}
+
+	for _, match := range noIntroTag.FindAllStringSubmatch(name, -1) {
+		if match[2] != "" {
+			tags.flags = append(tags.flags, strings.ToLower(match[2]))
+			continue
+		}
+
+		parts := strings.Split(match[1], ",")
+		for i := range parts {
+			parts[i] = strings.TrimSpace(parts[i])
+		}
+
+		regions, languages := true, true
+		for _, part := range parts {
+			regions = regions && noIntroRegions[strings.ToLower(part)]
+			languages = languages && noIntroLanguage.MatchString(part)
+		}
+
+		switch {
+		case regions:
+			for _, part := range parts {
+				tags.regions = append(tags.regions, strings.ToLower(part))
+			}
+		case languages:
+			for _, part := range parts {
+				tags.languages = append(tags.languages, strings.ToLower(part))
+			}
+		default:
+			flag := strings.ToLower(match[1])
+			if m := noIntroRevision.FindStringSubmatch(flag); m != nil {
+				tags.revision = m[1]
+			}
+			tags.flags = append(tags.flags, flag)
+			// Also allow matching just the first word, so beta
+			// matches (Beta 2)
+			if i := strings.IndexByte(flag, ' '); i > 0 {
+				tags.flags = append(tags.flags, flag[:i])
+			}
+		}
+	}
+
+	return tags
+}
+
+func (t nameTags) has(tag string) bool {
+	tag = strings.ToLower(tag)
+	for _, list := range [][]string{t.regions, t.languages, t.flags} {
+		for _, s := range list {
+			if s == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (t nameTags) hasAny(tags []string) bool {
+	for _, tag := range tags {
+		if t.has(tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter selects which games in a datafile are kept. Tags are matched
+// case-insensitively against the regions, languages and other tags in the
+// No-Intro style game name, for example usa, en, beta or bios
+type Filter struct {
+	Include        []string // Keep only games with any of these tags
+	Exclude        []string // Drop games with any of these tags
+	OneGameOneROM  bool     // Keep only the best game from each parent/clone group
+	RegionPriority []string // Preferred regions for OneGameOneROM, best first
+}
+
+func (f Filter) keep(tags nameTags) bool {
+	if len(f.Include) > 0 && !tags.hasAny(f.Include) {
+		return false
+	}
+	return !tags.hasAny(f.Exclude)
+}
+
+// rank returns how preferable a game is ignoring its revision, lower is
+// better. Games from an earlier region in the priority list win, then final
+// releases over prereleases
+func (f Filter) rank(tags nameTags) (int, bool) {
+	region := len(f.RegionPriority)
+	for i, r := range f.RegionPriority {
+		if tags.has(r) {
+			region = i
+			break
+		}
+	}
+
+	return region, tags.hasAny(noIntroPrerelease)
+}
+
+// isNumber reports whether s is made up of only digits
+func isNumber(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// compareRevisions compares two revisions such as 1, 1.02 or a, returning
+// -1, 0 or 1. If both are numbers the first dot-separated part is compared
+// as an integer and any later parts as decimal fractions, so 1.1 follows
+// 1.02 as No-Intro orders them. Otherwise parts are compared by length and
+// then alphabetically so b follows a and aa follows z. No revision comes
+// before any revision
+func compareRevisions(a, b string) int {
+	if a == b {
+		return 0
+	}
+
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	if a == "" {
+		as = nil
+	}
+	if b == "" {
+		bs = nil
+	}
+
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, y := as[i], bs[i]
+		switch {
+		case !isNumber(x) || !isNumber(y):
+		case i == 0:
+			x, y = strings.TrimLeft(x, "0"), strings.TrimLeft(y, "0")
+		case len(x) < len(y):
+			x += strings.Repeat("0", len(y)-len(x))
+		default:
+			y += strings.Repeat("0", len(x)-len(y))
+		}
+		switch {
+		case len(x) != len(y):
+			if len(x) < len(y) {
+				return -1
+			}
+			return 1
+		case x != y:
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	switch {
+	case len(as) < len(bs):
+		return -1
+	case len(as) > len(bs):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// better reports whether a game with tags a is preferable to one with tags
+// b, a later revision wins if they rank the same
+func (f Filter) better(a, b nameTags) bool {
+	ar, ap := f.rank(a)
+	br, bp := f.rank(b)
+	switch {
+	case ar != br:
+		return ar < br
+	case ap != bp:
+		return !ap
+	default:
+		return compareRevisions(a.revision, b.revision) > 0
+	}
+}
+
+// Filter removes any games not selected by f
+func (d *Datafile) Filter(f Filter) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	tags := make(map[*datGame]nameTags, len(d.games))
+	games := make([]*datGame, 0, len(d.games))
+	for _, game := range d.games {
+		t := parseTags(game.Name)
+		if f.keep(t) {
+			tags[game] = t
+			games = append(games, game)
+		}
+	}
+
+	if f.OneGameOneROM {
+		best := make(map[string]*datGame)
+		for _, game := range games {
+			parent := d.parentLocked(game.Name)
+			if b, ok := best[parent]; !ok || f.better(tags[game], tags[b]) {
+				best[parent] = game
+			}
+		}
+
+		selected := games[:0]
+		for _, game := range games {
+			if best[d.parentLocked(game.Name)] == game {
+				selected = append(selected, game)
+			}
+		}
+		games = selected
+	}
+
+	// Any clone whose parent was removed is now stored in its own set
+	d.games = games
+	d.reindex()
+}
@@ -0,0 +1,161 @@
+package rombo
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompareRevisions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"", "1", -1},
+		{"", "a", -1},
+		{"1", "", 1},
+		{"1", "2", -1},
+		{"2", "10", -1},
+		{"1.1", "1.02", 1},
+		{"1.02", "1.10", -1},
+		{"1.10", "1.1", 0},
+		{"1.1", "2.0", -1},
+		{"10.1", "9.2", 1},
+		{"01", "1", 0},
+		{"1", "1.1", -1},
+		{"a", "b", -1},
+		{"b", "a", 1},
+		{"z", "aa", -1},
+		{"a", "a", 0},
+	}
+
+	for _, tt := range tests {
+		if got := compareRevisions(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareRevisions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		name string
+		want nameTags
+	}{
+		{"Game", nameTags{}},
+		{
+			"Game (USA, Europe)",
+			nameTags{regions: []string{"usa", "europe"}},
+		},
+		{
+			"Game (Japan) (En,Ja)",
+			nameTags{regions: []string{"japan"}, languages: []string{"en", "ja"}},
+		},
+		{
+			"Game (Europe) (En,Zh-Hant)",
+			nameTags{regions: []string{"europe"}, languages: []string{"en", "zh-hant"}},
+		},
+		{
+			"Game (USA) (Beta 2) [b]",
+			nameTags{regions: []string{"usa"}, flags: []string{"beta 2", "beta", "b"}},
+		},
+		{
+			"Game (USA) (Rev A)",
+			nameTags{regions: []string{"usa"}, flags: []string{"rev a", "rev"}, revision: "a"},
+		},
+		{
+			"Game (Europe) (Rev 1.1)",
+			nameTags{regions: []string{"europe"}, flags: []string{"rev 1.1", "rev"}, revision: "1.1"},
+		},
+		{
+			"[BIOS] System (Japan, Taiwan)",
+			nameTags{regions: []string{"japan", "taiwan"}, flags: []string{"bios"}},
+		},
+		{
+			"Game (USA) (Unl)",
+			nameTags{regions: []string{"usa"}, flags: []string{"unl"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseTags(tt.name); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterIncludeExclude(t *testing.T) {
+	names := []string{
+		"Game (USA)",
+		"Game (Europe) (En,Fr,De)",
+		"Game (Japan) (Beta)",
+		"Game (USA) (Proto 2)",
+		"[BIOS] System (World)",
+	}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   []string
+	}{
+		{"none", Filter{}, names},
+		{"include region", Filter{Include: []string{"usa"}}, []string{"Game (USA)", "Game (USA) (Proto 2)"}},
+		{"include language", Filter{Include: []string{"FR"}}, []string{"Game (Europe) (En,Fr,De)"}},
+		{"include any", Filter{Include: []string{"japan", "bios"}}, []string{"Game (Japan) (Beta)", "[BIOS] System (World)"}},
+		{"exclude first word", Filter{Exclude: []string{"beta", "proto"}}, []string{"Game (USA)", "Game (Europe) (En,Fr,De)", "[BIOS] System (World)"}},
+		{"include and exclude", Filter{Include: []string{"usa"}, Exclude: []string{"proto"}}, []string{"Game (USA)"}},
+		{"no match", Filter{Include: []string{"brazil"}}, []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewEmptyDatafile()
+			for _, name := range names {
+				d.games = append(d.games, &datGame{Name: name})
+			}
+			d.reindex()
+
+			d.Filter(tt.filter)
+
+			if got := gameNames(d); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterOneGameOneROM(t *testing.T) {
+	tests := []struct {
+		name  string
+		games []string
+		want  string
+	}{
+		{"letter revision", []string{"Game (USA)", "Game (USA) (Rev A)", "Game (USA) (Rev B)"}, "Game (USA) (Rev B)"},
+		{"letter revision first", []string{"Game (USA) (Rev B)", "Game (USA) (Rev A)", "Game (USA)"}, "Game (USA) (Rev B)"},
+		{"numeric revision", []string{"Game (USA) (Rev 9)", "Game (USA) (Rev 10)", "Game (USA)"}, "Game (USA) (Rev 10)"},
+		{"decimal revision", []string{"Game (USA) (Rev 1.1)", "Game (USA) (Rev 1.02)"}, "Game (USA) (Rev 1.1)"},
+		{"region before revision", []string{"Game (Europe) (Rev 2)", "Game (USA)"}, "Game (USA)"},
+		{"release before revision", []string{"Game (USA) (Beta) (Rev 2)", "Game (USA) (Rev 1)"}, "Game (USA) (Rev 1)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewEmptyDatafile()
+			for i, name := range tt.games {
+				game := &datGame{Name: name}
+				if i > 0 {
+					game.CloneOf = tt.games[0]
+				}
+				d.games = append(d.games, game)
+			}
+			d.reindex()
+
+			d.Filter(Filter{OneGameOneROM: true, RegionPriority: []string{"usa", "europe"}})
+
+			if got := gameNames(d); !reflect.DeepEqual(got, []string{tt.want}) {
+				t.Errorf("got %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
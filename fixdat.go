@@ -0,0 +1,68 @@
+package rombo
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	fixdatPrefix = "fix_"
+)
+
+// fixdatHeader returns a header identifying the document as a fixdat for
+// the original datafile
+func (d *Datafile) fixdatHeader() *datHeader {
+	header := datHeader{
+		Date: time.Now().Format("2006-01-02"),
+	}
+
+	if d.header != nil {
+		header.Name = fixdatPrefix + d.header.Name
+		header.Description = fixdatPrefix + d.header.Description
+		header.Version = d.header.Version
+		header.ClrMamePro = d.header.ClrMamePro
+	}
+
+	return &header
+}
+
+// annotate adds a comment to each game listing which ROMs are missing and
+// which are bad dumps that are missing
+func annotate(games []*datGame) {
+	for _, game := range games {
+		comments := make([]string, 0, len(game.ROMs)+len(game.Disks))
+		for _, rom := range game.ROMs {
+			if rom.Status == statusBadDump {
+				comments = append(comments, fmt.Sprintf("bad: %s", rom.Name))
+			} else {
+				comments = append(comments, fmt.Sprintf("missing: %s", rom.Name))
+			}
+		}
+		for _, disk := range game.Disks {
+			if disk.Status == statusBadDump {
+				comments = append(comments, fmt.Sprintf("bad: %s", disk.filename()))
+			} else {
+				comments = append(comments, fmt.Sprintf("missing: %s", disk.filename()))
+			}
+		}
+		game.Comment = append(append([]string{}, game.Comment...), comments...)
+	}
+}
+
+// Fixdat returns a datafile in the requested format containing only the
+// ROMs that haven't been found, with a header identifying it as a fixdat.
+// Each game can optionally be annotated with which of its ROMs are missing
+// and which are bad dumps
+func (d *Datafile) Fixdat(format Format, annotated bool) ([]byte, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	document := d.remaining()
+	document.Header = d.fixdatHeader()
+
+	if annotated {
+		annotate(document.Games)
+	}
+
+	return marshalDocument(document, format)
+}
@@ -1,10 +1,28 @@
 module github.com/bodgit/rombo
 
-go 1.13
+go 1.21
 
 require (
+	github.com/bodgit/sevenzip v1.6.0
 	github.com/gabriel-vasile/mimetype v1.0.0
-	github.com/jbowtie/gokogiri v0.0.0-20190301021639-37f655d3078f
+	github.com/klauspost/compress v1.17.9
+	github.com/nwaples/rardecode/v2 v2.2.0
 	github.com/urfave/cli v1.22.1
 	github.com/uwedeportivo/torrentzip v1.0.0
 )
+
+require (
+	github.com/andybalholm/brotli v1.1.1 // indirect
+	github.com/bodgit/plumbing v1.3.0 // indirect
+	github.com/bodgit/windows v1.0.1 // indirect
+	github.com/cpuguy83/go-md2man/v2 v2.0.0-20190314233015-f79a8a8ca69d // indirect
+	github.com/hashicorp/errwrap v1.0.0 // indirect
+	github.com/hashicorp/go-multierror v1.1.1 // indirect
+	github.com/hashicorp/golang-lru/v2 v2.0.7 // indirect
+	github.com/pierrec/lz4/v4 v4.1.21 // indirect
+	github.com/russross/blackfriday/v2 v2.0.1 // indirect
+	github.com/shurcooL/sanitized_anchor_name v1.0.0 // indirect
+	github.com/ulikunitz/xz v0.5.12 // indirect
+	go4.org v0.0.0-20200411211856-f5505b9728dd // indirect
+	golang.org/x/text v0.20.0 // indirect
+)
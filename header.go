@@ -0,0 +1,360 @@
+package rombo
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/bodgit/rombo/internal/plumbing"
+)
+
+const (
+	headerMaxSize = 64 << 20 // Larger than any image that uses a copier header
+)
+
+// Builtin ClrMamePro header detectors for the systems No-Intro dats hash
+// without their copier headers
+var builtinDetectors = map[string]string{
+	"no-intro_nes.xml": `<detector>
+	<name>No-Intro_NES.xml</name>
+	<rule start_offset="10" end_offset="EOF" operation="none">
+		<data offset="0" value="4E45531A" result="true"/>
+	</rule>
+</detector>`,
+	"no-intro_fds.xml": `<detector>
+	<name>No-Intro_FDS.xml</name>
+	<rule start_offset="10" end_offset="EOF" operation="none">
+		<data offset="0" value="464453" result="true"/>
+	</rule>
+</detector>`,
+	"no-intro_lnx.xml": `<detector>
+	<name>No-Intro_LNX.xml</name>
+	<rule start_offset="40" end_offset="EOF" operation="none">
+		<data offset="0" value="4C594E58" result="true"/>
+	</rule>
+</detector>`,
+	"no-intro_a7800.xml": `<detector>
+	<name>No-Intro_A7800.xml</name>
+	<rule start_offset="80" end_offset="EOF" operation="none">
+		<data offset="1" value="415441524937383030" result="true"/>
+	</rule>
+	<rule start_offset="80" end_offset="EOF" operation="none">
+		<data offset="64" value="41435455414C20434152542044415441205354415254532048455245" result="true"/>
+	</rule>
+</detector>`,
+}
+
+type headerTest struct {
+	XMLName  xml.Name
+	Offset   string `xml:"offset,attr"`
+	Value    string `xml:"value,attr"`
+	Mask     string `xml:"mask,attr"`
+	Result   string `xml:"result,attr"`
+	Size     string `xml:"size,attr"`
+	Operator string `xml:"operator,attr"`
+}
+
+type headerRule struct {
+	StartOffset string       `xml:"start_offset,attr"`
+	EndOffset   string       `xml:"end_offset,attr"`
+	Operation   string       `xml:"operation,attr"`
+	Tests       []headerTest `xml:",any"`
+}
+
+// headerDetector is a ClrMamePro header detector, as referenced by the
+// header attribute in the clrmamepro element of a dat file
+type headerDetector struct {
+	XMLName xml.Name     `xml:"detector"`
+	Name    string       `xml:"name"`
+	Author  string       `xml:"author"`
+	Version string       `xml:"version"`
+	Rules   []headerRule `xml:"rule"`
+}
+
+// headerPayload is the part of a file that remains once the copier header
+// has been removed
+type headerPayload struct {
+	start     int64
+	end       int64
+	operation string
+}
+
+// loadHeaderDetector finds the detector called name, looking in dir first,
+// if set, before the builtin detectors. It returns nil if there isn't one
+func loadHeaderDetector(name, dir string) (*headerDetector, error) {
+	var b []byte
+	if dir != "" {
+		var err error
+		b, err = ioutil.ReadFile(filepath.Join(dir, filepath.Base(name)))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	if b == nil {
+		s, ok := builtinDetectors[strings.ToLower(filepath.Base(name))]
+		if !ok {
+			return nil, nil
+		}
+		b = []byte(s)
+	}
+
+	detector := headerDetector{}
+	if err := xml.Unmarshal(b, &detector); err != nil {
+		return nil, err
+	}
+
+	return &detector, nil
+}
+
+// headerOffset parses a hexadecimal offset, negative offsets and "EOF" are
+// relative to the end of the file
+func headerOffset(s string, def, size int64) (int64, error) {
+	switch strings.ToUpper(s) {
+	case "":
+		return def, nil
+	case "EOF":
+		return size, nil
+	}
+
+	offset, err := strconv.ParseInt(s, 16, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	if offset < 0 {
+		offset += size
+	}
+
+	return offset, nil
+}
+
+func headerResult(s string) bool {
+	return !strings.EqualFold(s, "false")
+}
+
+func (t headerTest) match(b []byte) (bool, error) {
+	size := int64(len(b))
+
+	switch t.XMLName.Local {
+	case "data", "and", "or", "xor":
+		offset, err := headerOffset(t.Offset, 0, size)
+		if err != nil {
+			return false, err
+		}
+
+		value, err := hex.DecodeString(t.Value)
+		if err != nil {
+			return false, err
+		}
+
+		if offset < 0 || offset+int64(len(value)) > size {
+			return !headerResult(t.Result), nil
+		}
+
+		data := append([]byte{}, b[offset:offset+int64(len(value))]...)
+
+		if t.XMLName.Local != "data" {
+			mask, err := hex.DecodeString(t.Mask)
+			if err != nil {
+				return false, err
+			}
+			if len(mask) != len(value) {
+				return false, fmt.Errorf("mask and value lengths differ in %s test", t.XMLName.Local)
+			}
+			for i := range data {
+				switch t.XMLName.Local {
+				case "and":
+					data[i] &= mask[i]
+				case "or":
+					data[i] |= mask[i]
+				case "xor":
+					data[i] ^= mask[i]
+				}
+			}
+		}
+
+		return bytes.Equal(data, value) == headerResult(t.Result), nil
+	case "file":
+		var matched bool
+		if strings.EqualFold(t.Size, "PO2") {
+			matched = size > 0 && size&(size-1) == 0
+		} else {
+			expected, err := strconv.ParseInt(t.Size, 16, 64)
+			if err != nil {
+				return false, err
+			}
+
+			switch strings.ToLower(t.Operator) {
+			case "less":
+				matched = size < expected
+			case "greater":
+				matched = size > expected
+			default:
+				matched = size == expected
+			}
+		}
+
+		return matched == headerResult(t.Result), nil
+	default:
+		return false, fmt.Errorf("unsupported header test %s", t.XMLName.Local)
+	}
+}
+
+// detect returns the payload of b according to the first rule that
+// matches, if any
+func (d *headerDetector) detect(b []byte) (*headerPayload, error) {
+	size := int64(len(b))
+
+Rule:
+	for _, rule := range d.Rules {
+		for _, test := range rule.Tests {
+			ok, err := test.match(b)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue Rule
+			}
+		}
+
+		start, err := headerOffset(rule.StartOffset, 0, size)
+		if err != nil {
+			return nil, err
+		}
+
+		end, err := headerOffset(rule.EndOffset, size, size)
+		if err != nil {
+			return nil, err
+		}
+
+		if start < 0 || end > size || start >= end {
+			continue
+		}
+
+		return &headerPayload{
+			start:     start,
+			end:       end,
+			operation: strings.ToLower(rule.Operation),
+		}, nil
+	}
+
+	return nil, nil
+}
+
+// extract returns the payload from the whole file b
+func (p *headerPayload) extract(b []byte) ([]byte, error) {
+	data := append([]byte{}, b[p.start:p.end]...)
+
+	switch p.operation {
+	case "", "none":
+	case "bitswap":
+		for i, c := range data {
+			var r byte
+			for j := 0; j < 8; j++ {
+				r = r<<1 | c>>j&1
+			}
+			data[i] = r
+		}
+	case "byteswap":
+		for i := 0; i+1 < len(data); i += 2 {
+			data[i], data[i+1] = data[i+1], data[i]
+		}
+	case "wordswap":
+		for i := 0; i+3 < len(data); i += 4 {
+			data[i], data[i+1], data[i+2], data[i+3] = data[i+2], data[i+3], data[i], data[i+1]
+		}
+	case "wordbyteswap":
+		for i := 0; i+3 < len(data); i += 4 {
+			data[i], data[i+1], data[i+2], data[i+3] = data[i+3], data[i+2], data[i+1], data[i]
+		}
+	default:
+		return nil, fmt.Errorf("unsupported header operation %s", p.operation)
+	}
+
+	return data, nil
+}
+
+// reader returns the payload from the whole file read from r
+func (p *headerPayload) reader(r io.Reader) (io.Reader, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r, headerMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(b)) < p.end {
+		return nil, fmt.Errorf("file too short for header payload")
+	}
+
+	data, err := p.extract(b)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(data), nil
+}
+
+// wrap returns the payload from the whole file read from rc, or rc itself
+// if there is no payload
+func (p *headerPayload) wrap(rc io.ReadCloser) (io.ReadCloser, error) {
+	if p == nil {
+		return rc, nil
+	}
+
+	r, err := p.reader(rc)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+
+	return plumbing.MultiReadCloser(r, rc), nil
+}
+
+// findHeaderless checks the file of the given size returned by open for a
+// copier header and if one is found, looks for any ROMs matching the
+// payload
+func (r *Rombo) findHeaderless(open func() (io.ReadCloser, error), size uint64) ([]ROM, *headerPayload, checksum, error) {
+	if r.detector == nil || size > headerMaxSize {
+		return nil, nil, checksum{}, nil
+	}
+
+	rc, err := open()
+	if err != nil {
+		return nil, nil, checksum{}, err
+	}
+	defer rc.Close()
+
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, nil, checksum{}, err
+	}
+
+	payload, err := r.detector.detect(b)
+	if err != nil || payload == nil {
+		return nil, nil, checksum{}, err
+	}
+
+	data, err := payload.extract(b)
+	if err != nil {
+		return nil, nil, checksum{}, err
+	}
+
+	sum, err := checksumReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, checksum{}, err
+	}
+
+	roms, _, err := r.datafile.findROMByChecksums(sum.size, sum.crc, sum.md5, sum.sha1)
+	if err != nil {
+		return nil, nil, checksum{}, err
+	}
+
+	return roms, payload, sum, nil
+}
@@ -0,0 +1,264 @@
+package rombo
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+func TestHeaderOffset(t *testing.T) {
+	tests := []struct {
+		s    string
+		def  int64
+		want int64
+		err  bool
+	}{
+		{"", 5, 5, false},
+		{"EOF", 0, 256, false},
+		{"eof", 0, 256, false},
+		{"10", 0, 16, false},
+		{"1A0", 0, 416, false},
+		{"-10", 0, 240, false},
+		{"zz", 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := headerOffset(tt.s, tt.def, 256)
+		if (err != nil) != tt.err {
+			t.Errorf("headerOffset(%q) error %v", tt.s, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("headerOffset(%q) = %d, want %d", tt.s, got, tt.want)
+		}
+	}
+}
+
+// withHeader returns a file of the given size with header copied to the
+// start and the rest filled with a pattern
+func withHeader(header []byte, offset, size int) []byte {
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	copy(b[offset:], header)
+	return b
+}
+
+func TestBuiltinDetectors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		start int64
+	}{
+		{"No-Intro_NES.xml", withHeader([]byte("NES\x1a"), 0, 1024), 0x10},
+		{"No-Intro_NES.xml", withHeader([]byte("NES\x1b"), 0, 1024), -1},
+		{"No-Intro_FDS.xml", withHeader([]byte("FDS"), 0, 1024), 0x10},
+		{"No-Intro_LNX.xml", withHeader([]byte("LYNX"), 0, 1024), 0x40},
+		{"No-Intro_A7800.xml", withHeader([]byte("ATARI7800"), 1, 1024), 0x80},
+		{"No-Intro_A7800.xml", withHeader([]byte("ACTUAL CART DATA STARTS HERE"), 0x64, 1024), 0x80},
+		{"No-Intro_A7800.xml", withHeader([]byte("ATARI7800"), 0, 1024), -1},
+		// Too short to have anything after the header
+		{"No-Intro_NES.xml", []byte("NES\x1a"), -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			detector, err := loadHeaderDetector(tt.name, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if detector == nil {
+				t.Fatal("no detector")
+			}
+
+			payload, err := detector.detect(tt.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.start < 0 {
+				if payload != nil {
+					t.Errorf("unexpected payload %+v", payload)
+				}
+				return
+			}
+
+			if payload == nil || payload.start != tt.start || payload.end != int64(len(tt.input)) {
+				t.Errorf("got payload %+v, want %d-%d", payload, tt.start, len(tt.input))
+			}
+		})
+	}
+
+	if detector, err := loadHeaderDetector("unknown.xml", ""); err != nil || detector != nil {
+		t.Errorf("got %v, %v for an unknown detector", detector, err)
+	}
+}
+
+func TestHeaderTest(t *testing.T) {
+	input := []byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0}
+
+	tests := []struct {
+		test string
+		want bool
+		err  bool
+	}{
+		{`<data offset="0" value="1234"/>`, true, false},
+		{`<data offset="1" value="1234"/>`, false, false},
+		{`<data offset="0" value="1234" result="false"/>`, false, false},
+		{`<data offset="-2" value="DEF0"/>`, true, false},
+		{`<data offset="7" value="F000"/>`, false, false},
+		{`<data offset="7" value="F000" result="false"/>`, true, false},
+		{`<and offset="0" mask="F0F0" value="1030"/>`, true, false},
+		{`<or offset="0" mask="0F0F" value="1F3F"/>`, true, false},
+		{`<xor offset="0" mask="FFFF" value="EDCB"/>`, true, false},
+		{`<xor offset="0" mask="FF" value="EDCB"/>`, false, true},
+		{`<file size="8"/>`, true, false},
+		{`<file size="8" result="false"/>`, false, false},
+		{`<file size="10" operator="less"/>`, true, false},
+		{`<file size="4" operator="greater"/>`, true, false},
+		{`<file size="PO2"/>`, true, false},
+		{`<data offset="0" value="zz"/>`, false, true},
+		{`<unknown/>`, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.test, func(t *testing.T) {
+			var test headerTest
+			if err := xml.Unmarshal([]byte(tt.test), &test); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := test.match(input)
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeaderPayload(t *testing.T) {
+	input := []byte{0xff, 0xff, 0x01, 0x02, 0x03, 0x04, 0x80, 0x0f}
+
+	tests := []struct {
+		operation string
+		want      []byte
+		err       bool
+	}{
+		{"none", []byte{0x01, 0x02, 0x03, 0x04, 0x80, 0x0f}, false},
+		{"bitswap", []byte{0x80, 0x40, 0xc0, 0x20, 0x01, 0xf0}, false},
+		{"byteswap", []byte{0x02, 0x01, 0x04, 0x03, 0x0f, 0x80}, false},
+		{"wordswap", []byte{0x03, 0x04, 0x01, 0x02, 0x80, 0x0f}, false},
+		{"wordbyteswap", []byte{0x04, 0x03, 0x02, 0x01, 0x80, 0x0f}, false},
+		{"unknown", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.operation, func(t *testing.T) {
+			p := &headerPayload{start: 2, end: int64(len(input)), operation: tt.operation}
+
+			rc, err := p.wrap(ioutil.NopCloser(bytes.NewReader(input)))
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v", err)
+			}
+			if err != nil {
+				return
+			}
+			defer rc.Close()
+
+			got, err := ioutil.ReadAll(rc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("got %x, want %x", got, tt.want)
+			}
+		})
+	}
+
+	// Without a payload the whole file is used
+	var p *headerPayload
+	rc, err := p.wrap(ioutil.NopCloser(bytes.NewReader(input)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadAll(rc); !bytes.Equal(got, input) {
+		t.Errorf("got %x, want %x", got, input)
+	}
+
+	p = &headerPayload{start: 2, end: 16}
+	if _, err := p.wrap(ioutil.NopCloser(bytes.NewReader(input))); err == nil {
+		t.Error("expected an error for a short file")
+	}
+}
+
+func TestFindHeaderless(t *testing.T) {
+	payload := []byte("this is some nes prg rom data")
+	input := append(withHeader([]byte("NES\x1a"), 0, 16), payload...)
+
+	tests := []struct {
+		name   string
+		header string
+		input  []byte
+		found  bool
+	}{
+		{"headered", "No-Intro_NES.xml", input, true},
+		{"headerless", "No-Intro_NES.xml", payload, false},
+		{"no detector", "", input, false},
+		{"unknown detector", "unknown.xml", input, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := NewDatafile([]byte(fmt.Sprintf(`<datafile>
+	<header>
+		<name>NES</name>
+		<clrmamepro header="%s"/>
+	</header>
+	<game name="a">
+		<description>A</description>
+		<rom name="a.nes" size="%d" crc="%08x"/>
+	</game>
+</datafile>`, tt.header, len(payload), crc32.ChecksumIEEE(payload))))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, err := New(d, log.New(ioutil.Discard, "", 0), false, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			open := func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(bytes.NewReader(tt.input)), nil
+			}
+
+			roms, p, sum, err := r.findHeaderless(open, uint64(len(tt.input)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !tt.found {
+				if len(roms) != 0 {
+					t.Errorf("unexpected ROMs %+v", roms)
+				}
+				return
+			}
+
+			if len(roms) != 1 || roms[0].Filename != "a.nes" {
+				t.Fatalf("got ROMs %+v", roms)
+			}
+			if p == nil || p.start != 0x10 || sum.crc != fmt.Sprintf("%08x", crc32.ChecksumIEEE(payload)) {
+				t.Errorf("got payload %+v and checksum %+v", p, sum)
+			}
+		})
+	}
+}
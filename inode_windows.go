@@ -0,0 +1,13 @@
+//go:build windows
+// +build windows
+
+package rombo
+
+import (
+	"os"
+)
+
+func inode(info os.FileInfo) uint64 {
+	// No inode numbers, so rely on the size and modification time
+	return 0
+}
@@ -45,3 +45,23 @@ func (wc *WriteCounter) WriteAt(p []byte, off int64) (int, error) {
 func (wc *WriteCounter) Count() uint64 {
 	return atomic.LoadUint64(&wc.count)
 }
+
+type multiReadCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (m *multiReadCloser) Close() (err error) {
+	for _, c := range m.closers {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return
+}
+
+// MultiReadCloser returns an io.ReadCloser that reads from r and closes all
+// of closers in order when closed
+func MultiReadCloser(r io.Reader, closers ...io.Closer) io.ReadCloser {
+	return &multiReadCloser{r, closers}
+}
@@ -17,6 +17,32 @@ type Layout interface {
 	ignorePath(string) bool
 }
 
+// zipFormatter is implemented by any layout that writes something other
+// than torrentzip archives
+type zipFormatter interface {
+	zipFormat() zipFormat
+}
+
+func layoutZipFormat(layout Layout) zipFormat {
+	if f, ok := layout.(zipFormatter); ok {
+		return f.zipFormat()
+	}
+	return torrentZip
+}
+
+// headerStripper is implemented by any layout that removes copier headers
+// from ROMs that are matched without them, the default is to keep them
+type headerStripper interface {
+	stripHeaders() bool
+}
+
+func layoutStripsHeaders(layout Layout) bool {
+	if s, ok := layout.(headerStripper); ok {
+		return s.stripHeaders()
+	}
+	return false
+}
+
 func firstAlphanumeric(s string) (string, error) {
 	s = strings.TrimPrefix(s, noIntroBIOS)
 	for _, c := range s {
@@ -36,8 +62,18 @@ func firstAlphanumeric(s string) (string, error) {
 type SimpleCompressed struct{}
 
 func (SimpleCompressed) exportPath(rom ROM) (string, bool, string, error) {
+	// Software list sets live in a directory named after the list, so
+	// the target can be used directly as a MAME ROM path
+	dir := rom.SoftwareList
+
+	// CHDs are already compressed so they sit in a directory alongside
+	// the zip, which is what MAME expects
+	if rom.Disk {
+		return filepath.Join(dir, rom.Game, rom.Filename), false, "", nil
+	}
+
 	// Create a zip using the name of the game containing the filename
-	return rom.Game + ".zip", true, rom.Filename, nil
+	return filepath.Join(dir, rom.Game+".zip"), true, rom.Filename, nil
 }
 
 func (SimpleCompressed) ignorePath(relpath string) bool {
@@ -45,6 +81,46 @@ func (SimpleCompressed) ignorePath(relpath string) bool {
 	return false
 }
 
+func (SimpleCompressed) stripHeaders() bool {
+	// Store exactly what the datafile describes
+	return true
+}
+
+// SimpleZstd is like SimpleCompressed but writes RomVault's RVZSTD
+// zstd-compressed zip archives instead of torrentzip
+type SimpleZstd struct {
+	SimpleCompressed
+}
+
+func (SimpleZstd) zipFormat() zipFormat {
+	return rvzstdZip
+}
+
+// SimpleGrouped is like SimpleCompressed but keeps each set in a directory
+// named after its top-level parent, so all clones of a game, including
+// clones of clones, are found together
+type SimpleGrouped struct {
+	SimpleCompressed
+}
+
+func (SimpleGrouped) exportPath(rom ROM) (string, bool, string, error) {
+	group := rom.Parent
+	switch {
+	case group != "":
+	case rom.CloneOf != "":
+		group = rom.CloneOf
+	default:
+		group = rom.Game
+	}
+	dir := filepath.Join(rom.SoftwareList, group)
+
+	if rom.Disk {
+		return filepath.Join(dir, rom.Game, rom.Filename), false, "", nil
+	}
+
+	return filepath.Join(dir, rom.Game+".zip"), true, rom.Filename, nil
+}
+
 type MegaSD struct{}
 
 func (MegaSD) exportPath(rom ROM) (string, bool, string, error) {
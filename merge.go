@@ -0,0 +1,132 @@
+package rombo
+
+import (
+	"fmt"
+)
+
+// Duplicates decides what happens when a game being merged into a datafile
+// has the same name as one already present
+type Duplicates int
+
+const (
+	KeepFirst      Duplicates = iota // Ignore the new game
+	KeepLast                         // Replace the existing game
+	DuplicateError                   // Stop with an error
+	Union                            // Add any ROMs the existing game has no name for
+)
+
+// unionGame returns a copy of game with any ROMs and disks from other that
+// it doesn't already have. ROMs and disks are matched by name alone, if both
+// games have one with the same name but different sizes or hashes then the
+// one in game is kept
+func unionGame(game, other *datGame) *datGame {
+	g := *game
+	g.ROMs = append([]*datROM{}, game.ROMs...)
+	g.Disks = append([]*datDisk{}, game.Disks...)
+
+	roms := make(map[string]bool, len(g.ROMs))
+	for _, rom := range g.ROMs {
+		roms[rom.Name] = true
+	}
+	for _, rom := range other.ROMs {
+		if !roms[rom.Name] {
+			roms[rom.Name] = true
+			g.ROMs = append(g.ROMs, rom)
+		}
+	}
+
+	disks := make(map[string]bool, len(g.Disks))
+	for _, disk := range g.Disks {
+		disks[disk.Name] = true
+	}
+	for _, disk := range other.Disks {
+		if !disks[disk.Name] {
+			disks[disk.Name] = true
+			g.Disks = append(g.Disks, disk)
+		}
+	}
+
+	return &g
+}
+
+// mergeGames returns games with other merged in, handling any games with
+// the same name according to duplicates
+func mergeGames(games, other []*datGame, duplicates Duplicates) ([]*datGame, error) {
+	merged := append(make([]*datGame, 0, len(games)+len(other)), games...)
+
+	index := make(map[string]int, len(merged))
+	for i, game := range merged {
+		if _, ok := index[game.Name]; !ok {
+			index[game.Name] = i
+		}
+	}
+
+	for _, game := range other {
+		i, ok := index[game.Name]
+		if !ok {
+			index[game.Name] = len(merged)
+			merged = append(merged, game)
+			continue
+		}
+
+		switch duplicates {
+		case KeepFirst:
+		case KeepLast:
+			merged[i] = game
+		case DuplicateError:
+			return nil, fmt.Errorf("duplicate game: %s", game.Name)
+		case Union:
+			merged[i] = unionGame(merged[i], game)
+		default:
+			return nil, fmt.Errorf("unknown duplicate handling: %d", duplicates)
+		}
+	}
+
+	return merged, nil
+}
+
+// Merge adds the games from another datafile in any supported format,
+// handling any games that are already present according to duplicates
+func (d *Datafile) Merge(b []byte, duplicates Duplicates) error {
+	input, _, err := parseDatafile(b)
+	if err != nil {
+		return err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	games, err := mergeGames(d.games, input.Games, duplicates)
+	if err != nil {
+		return err
+	}
+
+	d.games = games
+	d.reindex()
+
+	return nil
+}
+
+// OverrideHeader replaces the name, description, version and author in the
+// header with any of the values that are not empty
+func (d *Datafile) OverrideHeader(name, description, version, author string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.header == nil {
+		d.header = &datHeader{}
+	}
+
+	if name != "" {
+		d.header.Name = name
+	}
+	if description != "" {
+		d.header.Description = description
+	}
+	if version != "" {
+		d.header.Version = version
+	}
+	if author != "" {
+		d.header.Author = author
+	}
+}
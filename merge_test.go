@@ -0,0 +1,91 @@
+package rombo
+
+import (
+	"reflect"
+	"testing"
+)
+
+const (
+	mergeFirst = `<datafile>
+	<game name="a">
+		<description>A</description>
+		<rom name="a.rom" size="1" crc="00000001"/>
+		<rom name="b.rom" size="1" crc="00000002"/>
+		<disk name="c" sha1="0000000000000000000000000000000000000003"/>
+	</game>
+</datafile>`
+	mergeSecond = `<datafile>
+	<game name="a">
+		<description>A again</description>
+		<rom name="a.rom" size="1" crc="00000001"/>
+		<rom name="b.rom" size="2" crc="00000004"/>
+		<rom name="d.rom" size="1" crc="00000005"/>
+		<disk name="c" sha1="0000000000000000000000000000000000000006"/>
+		<disk name="e" sha1="0000000000000000000000000000000000000007"/>
+	</game>
+	<game name="b">
+		<description>B</description>
+		<rom name="f.rom" size="1" crc="00000008"/>
+	</game>
+</datafile>`
+)
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name        string
+		duplicates  Duplicates
+		description string
+		roms        []string
+		disks       []string
+	}{
+		{"keep first", KeepFirst, "A", []string{"a.rom:00000001", "b.rom:00000002"}, []string{"c:0000000000000000000000000000000000000003"}},
+		{"keep last", KeepLast, "A again", []string{"a.rom:00000001", "b.rom:00000004", "d.rom:00000005"}, []string{"c:0000000000000000000000000000000000000006", "e:0000000000000000000000000000000000000007"}},
+		{"union", Union, "A", []string{"a.rom:00000001", "b.rom:00000002", "d.rom:00000005"}, []string{"c:0000000000000000000000000000000000000003", "e:0000000000000000000000000000000000000007"}},
+		{"error", DuplicateError, "", nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := NewDatafile([]byte(mergeFirst))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = d.Merge([]byte(mergeSecond), tt.duplicates)
+			if tt.duplicates == DuplicateError {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(d.games) != 2 {
+				t.Fatalf("got %d games, want 2", len(d.games))
+			}
+
+			game := d.games[0]
+			if game.Description != tt.description {
+				t.Errorf("got description %q, want %q", game.Description, tt.description)
+			}
+
+			roms := make([]string, 0, len(game.ROMs))
+			for _, rom := range game.ROMs {
+				roms = append(roms, rom.Name+":"+rom.CRC)
+			}
+			if !reflect.DeepEqual(roms, tt.roms) {
+				t.Errorf("got ROMs %v, want %v", roms, tt.roms)
+			}
+
+			disks := make([]string, 0, len(game.Disks))
+			for _, disk := range game.Disks {
+				disks = append(disks, disk.Name+":"+disk.SHA1)
+			}
+			if !reflect.DeepEqual(disks, tt.disks) {
+				t.Errorf("got disks %v, want %v", disks, tt.disks)
+			}
+		})
+	}
+}
@@ -8,10 +8,10 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 
 	"github.com/gabriel-vasile/mimetype"
-	"github.com/uwedeportivo/torrentzip"
 )
 
 type ioCounter struct {
@@ -48,8 +48,8 @@ func (r *Rombo) findFiles(ctx context.Context, dir string) (<-chan string, <-cha
 				return nil
 			}
 
-			// Ignore anything that isn't a normal file
-			if !info.Mode().IsRegular() {
+			// Ignore anything that isn't a normal file, or is the cache
+			if !info.Mode().IsRegular() || (r.cache != nil && r.cache.isCacheFile(file)) {
 				return nil
 			}
 
@@ -92,11 +92,11 @@ func (r *Rombo) mergeFiles(ctx context.Context, in ...<-chan string) (<-chan str
 
 func (r *Rombo) mimeSplitter(ctx context.Context, in <-chan string) (<-chan string, <-chan string, <-chan error, error) {
 	out := make(chan string)
-	zip := make(chan string)
+	archive := make(chan string)
 	errc := make(chan error, 1)
 	go func() {
 		defer close(out)
-		defer close(zip)
+		defer close(archive)
 		defer close(errc)
 		for file := range in {
 			mime, err := mimetype.DetectFile(file)
@@ -104,10 +104,10 @@ func (r *Rombo) mimeSplitter(ctx context.Context, in <-chan string) (<-chan stri
 				errc <- err
 				return
 			}
-			switch mime.Extension() {
-			case ".zip":
+			switch {
+			case isArchive(mime.Extension()):
 				select {
-				case zip <- file:
+				case archive <- file:
 				case <-ctx.Done():
 					return
 				}
@@ -120,17 +120,22 @@ func (r *Rombo) mimeSplitter(ctx context.Context, in <-chan string) (<-chan stri
 			}
 		}
 	}()
-	return out, zip, errc, nil
+	return out, archive, errc, nil
 }
 
-func (r *Rombo) cleanFile(ctx context.Context, dir, file, sha string, size uint64, roms []ROM) error {
+func (r *Rombo) cleanFile(ctx context.Context, dir, file string, sum checksum, payload *headerPayload, roms []ROM) error {
 	matched := false
 	for _, rom := range roms {
-		relpath, _, _, err := r.layout.exportPath(rom)
+		relpath, _, _, err := r.exportPath(rom)
 		if err != nil {
 			return err
 		}
 
+		// The ROM is stored in another set
+		if relpath == "" {
+			continue
+		}
+
 		fullpath := filepath.Join(dir, relpath)
 
 		if fullpath == file {
@@ -152,50 +157,68 @@ func (r *Rombo) cleanFile(ctx context.Context, dir, file, sha string, size uint6
 	return nil
 }
 
-func (r *Rombo) exportFile(ctx context.Context, dir, file, sha string, size uint64, roms []ROM) error {
-	for _, rom := range roms {
-		relpath, zipped, name, err := r.layout.exportPath(rom)
-		if err != nil {
-			return err
+func (r *Rombo) exportFileToFile(file, fullpath string, sum checksum, payload *headerPayload) error {
+	rsum, err := r.checksumFile(fullpath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if os.IsNotExist(err) || rsum != sum {
+		if payload == nil {
+			r.logger.Printf("Copying \"%s\" to \"%s\"\n", file, fullpath)
+			if r.destructive {
+				return copyFile(file, fullpath)
+			}
+			return nil
 		}
 
-		fullpath := filepath.Join(dir, relpath)
+		r.logger.Printf("Copying \"%s\" without its header to \"%s\"\n", file, fullpath)
+		if r.destructive {
+			f, err := os.Open(file)
+			if err != nil {
+				return err
+			}
 
-		if zipped {
-			ok, rcrc, rsize, err := fileExistsInZip(fullpath, name)
-			if err != nil && !os.IsNotExist(err) {
+			fr, err := payload.wrap(f)
+			if err != nil {
 				return err
 			}
+			defer fr.Close()
 
-			if os.IsNotExist(err) || !ok || rcrc != rom.CRC || rsize != size {
-				r.logger.Printf("Archiving \"%s\" to \"%s\" as \"%s\"\n", file, fullpath, name)
-				if r.destructive {
-					f, err := os.Open(file)
-					if err != nil {
-						return err
-					}
+			return writeFile(fr, fullpath)
+		}
+	}
 
-					if err := createOrUpdateZip(fullpath, name, f); err != nil {
-						f.Close()
-						return err
-					}
+	return nil
+}
 
-					f.Close()
-				}
-			}
-		} else {
-			rsha, rsize, err := sha1Sum(fullpath)
-			if err != nil && !os.IsNotExist(err) {
-				return err
-			}
+func (r *Rombo) exportFile(ctx context.Context, dir, file string, sum checksum, payload *headerPayload, roms []ROM) error {
+	for _, rom := range roms {
+		relpath, zipped, name, err := r.exportPath(rom)
+		if err != nil {
+			return err
+		}
 
-			if os.IsNotExist(err) || rsha != sha || rsize != size {
-				r.logger.Printf("Copying \"%s\" to \"%s\"\n", file, fullpath)
-				if r.destructive {
-					if err := copyFile(file, fullpath); err != nil {
-						return err
-					}
-				}
+		fullpath := filepath.Join(dir, relpath)
+
+		switch {
+		case relpath == "":
+			// The ROM is stored in another set
+		case zipped:
+			// Archives are written once everything has been found
+			r.zips.add(fullpath, name, zipSource{
+				file:    file,
+				payload: payload,
+				crc:     sum.crc,
+				size:    sum.size,
+			})
+		default:
+			// Another worker could be writing to the same path
+			unlock := r.locks.lock(fullpath)
+			err := r.exportFileToFile(file, fullpath, sum, payload)
+			unlock()
+			if err != nil {
+				return err
 			}
 		}
 
@@ -207,7 +230,7 @@ func (r *Rombo) exportFile(ctx context.Context, dir, file, sha string, size uint
 	return nil
 }
 
-func (r *Rombo) verifyFile(ctx context.Context, dir, file, sha string, size uint64, roms []ROM) error {
+func (r *Rombo) verifyFile(ctx context.Context, dir, file string, sum checksum, payload *headerPayload, roms []ROM) error {
 	for _, rom := range roms {
 		if err := r.datafile.seenROM(rom); err != nil {
 			return err
@@ -217,26 +240,50 @@ func (r *Rombo) verifyFile(ctx context.Context, dir, file, sha string, size uint
 	return nil
 }
 
-func (r *Rombo) fileWorker(ctx context.Context, dir string, f func(context.Context, string, string, string, uint64, []ROM) error, in <-chan string) (<-chan error, error) {
+func (r *Rombo) fileWorker(ctx context.Context, dir string, f func(context.Context, string, string, checksum, *headerPayload, []ROM) error, in <-chan string) (<-chan error, error) {
 	errc := make(chan error, 1)
 	go func() {
 		defer close(errc)
 		for file := range in {
-			sha, size, err := sha1Sum(file)
+			sum, err := r.checksumFile(file)
 			if err != nil {
 				errc <- err
 				return
 			}
 
-			roms, _, err := r.datafile.findROMBySHA1(size, sha)
+			var roms []ROM
+			if sum.disk {
+				roms, _, err = r.datafile.findDisk(sum.sha1)
+			} else {
+				roms, _, err = r.datafile.findROMByChecksums(sum.size, sum.crc, sum.md5, sum.sha1)
+			}
 			if err != nil {
 				errc <- err
 				return
 			}
 
-			r.logger.Printf("Working on file \"%s\" with SHA1 %s\n", file, sha)
+			// Try again without any copier header
+			var payload *headerPayload
+			if len(roms) == 0 && !sum.disk {
+				hroms, hpayload, hsum, err := r.findHeaderless(func() (io.ReadCloser, error) {
+					return os.Open(file)
+				}, sum.size)
+				if err != nil {
+					errc <- err
+					return
+				}
+
+				if len(hroms) > 0 {
+					roms = hroms
+					if layoutStripsHeaders(r.layout) {
+						sum, payload = hsum, hpayload
+					}
+				}
+			}
+
+			r.logger.Printf("Working on file \"%s\" with SHA1 %s\n", file, sum.sha1)
 
-			if err := f(ctx, dir, file, sha, size, roms); err != nil {
+			if err := f(ctx, dir, file, sum, payload, roms); err != nil {
 				errc <- err
 				return
 			}
@@ -245,59 +292,81 @@ func (r *Rombo) fileWorker(ctx context.Context, dir string, f func(context.Conte
 	return errc, nil
 }
 
-func (r *Rombo) cleanZip(ctx context.Context, dir, file string) error {
-	reader, err := zip.OpenReader(file)
+func (r *Rombo) cleanArchive(ctx context.Context, dir, file string) error {
+	reader, closer, err := openArchive(file, r.cache)
 	if err != nil {
 		return err
 	}
-	defer reader.Close()
+	defer closer.Close()
 
-	evictees := make([]string, 0, len(reader.File))
+	files := reader.Files()
+	evictees := make([]string, 0, len(files))
 
 File:
-	for _, f := range reader.File {
-		roms, _, err := r.datafile.findROMByCRC(f.UncompressedSize64, zipCRC(f))
+	for _, f := range files {
+		// Only zip files are ever created so anything else is removed
+		if reader.Format() != ".zip" {
+			evictees = append(evictees, f.Name())
+			continue
+		}
+
+		roms, _, err := r.datafile.findROMByCRC(f.Size(), f.CRC())
 		if err != nil {
 			return err
 		}
 
 		for _, rom := range roms {
-			relpath, _, name, err := r.layout.exportPath(rom)
+			relpath, _, name, err := r.exportPath(rom)
 			if err != nil {
 				return err
 			}
 
+			// The ROM is stored in another set
+			if relpath == "" {
+				continue
+			}
+
 			fullpath := filepath.Join(dir, relpath)
 
-			if fullpath == file && name == f.Name {
+			if fullpath == file && name == f.Name() {
 				continue File
 			}
 		}
 
-		evictees = append(evictees, f.Name)
+		evictees = append(evictees, f.Name())
 	}
 
-	reader.Close()
+	closer.Close()
 
 	switch len(evictees) {
-	case len(reader.File): // XXX Might not work if there are directories
+	case len(files):
 		r.logger.Printf("Deleting \"%s\"\n", file)
 		if r.destructive {
 			return os.Remove(file)
 		}
 		return nil
 	case 0:
-		// Nothing to delete so check for torrentzip correctness
-		sha, _, err := sha1Sum(file)
+		// Nothing to delete so check for torrentzip or RVZSTD
+		// correctness
+		format := layoutZipFormat(r.layout)
+		if format == rvzstdZip {
+			// Any zstd encoder produces a valid archive so only the
+			// structure is checked
+			ok, err := isRVZSTD(file)
+			if err != nil || ok {
+				return err
+			}
+		}
+		sum, err := r.checksumFile(file)
 		if err != nil {
 			return err
 		}
-		tmpfile, nsha, err := recreateZip(file)
+		tmpfile, nsha, err := recreateZip(file, format)
 		if err != nil {
 			return err
 		}
 		defer os.Remove(tmpfile)
-		if sha != nsha {
+		if sum.sha1 != nsha {
 			r.logger.Printf("Replacing \"%s\"\n", file)
 			if r.destructive {
 				return copyFile(tmpfile, file)
@@ -309,7 +378,7 @@ File:
 	}
 
 	var tmpfile *os.File
-	var w *torrentzip.Writer
+	var w zipWriter
 
 	if r.destructive {
 		var err error
@@ -320,19 +389,19 @@ File:
 		}
 		defer os.Remove(tmpfile.Name())
 
-		w, err = torrentzip.NewWriter(tmpfile)
+		w, err = newZipWriter(layoutZipFormat(r.layout), tmpfile)
 		if err != nil {
 			return err
 		}
 	}
 
-	reader, err = zip.OpenReader(file)
+	zipReader, err := zip.OpenReader(file)
 	if err != nil {
 		return err
 	}
-	defer reader.Close()
+	defer zipReader.Close()
 
-	for _, f := range reader.File {
+	for _, f := range zipReader.File {
 		if len(evictees) > 0 && evictees[0] == f.Name {
 			r.logger.Printf("Removing \"%s\" from \"%s\"\n", f.Name, file)
 			evictees = evictees[1:]
@@ -358,7 +427,7 @@ File:
 		}
 	}
 
-	reader.Close()
+	zipReader.Close()
 
 	if r.destructive {
 		if err := w.Close(); err != nil {
@@ -377,69 +446,104 @@ File:
 	return nil
 }
 
-func (r *Rombo) exportZip(ctx context.Context, dir, file string) error {
-	reader, err := zip.OpenReader(file)
-	if err != nil {
+func (r *Rombo) exportArchiveFileToFile(file string, path memberPath, f archiveFile, payload *headerPayload, fullpath string) error {
+	rsum, err := r.checksumFile(fullpath)
+	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
-	defer reader.Close()
 
-	for _, f := range reader.File {
-		roms, _, err := r.datafile.findROMByCRC(f.UncompressedSize64, zipCRC(f))
+	changed := os.IsNotExist(err)
+	switch {
+	case changed:
+	case payload == nil:
+		// The CRC and size recorded in the archive are enough
+		changed = rsum.crc != f.CRC() || rsum.size != f.Size()
+	default:
+		sum, err := r.checksumArchiveFile(file, path, f, payload)
 		if err != nil {
 			return err
 		}
+		changed = rsum != sum
+	}
 
-		for _, rom := range roms {
-			relpath, zipped, name, err := r.layout.exportPath(rom)
+	if changed {
+		r.logger.Printf("Extracting \"%s\" from \"%s\" to \"%s\"\n", path, file, fullpath)
+		if r.destructive {
+			rc, err := f.Open()
 			if err != nil {
 				return err
 			}
 
-			fullpath := filepath.Join(dir, relpath)
+			fr, err := payload.wrap(rc)
+			if err != nil {
+				return err
+			}
+			defer fr.Close()
 
-			if zipped {
-				ok, rcrc, rsize, err := fileExistsInZip(fullpath, name)
-				if err != nil && !os.IsNotExist(err) {
-					return err
-				}
+			return writeFile(fr, fullpath)
+		}
+	}
 
-				if os.IsNotExist(err) || !ok || rcrc != zipCRC(f) || rsize != f.UncompressedSize64 {
-					r.logger.Printf("Extracting \"%s\" from \"%s\" and archiving to \"%s\" as \"%s\"\n", f.Name, file, fullpath, name)
-					if r.destructive {
-						fr, err := f.Open()
-						if err != nil {
-							return err
-						}
+	return nil
+}
 
-						if err := createOrUpdateZip(fullpath, name, fr); err != nil {
-							fr.Close()
-							return err
-						}
+func (r *Rombo) exportArchive(ctx context.Context, dir, file string) error {
+	reader, closer, err := openArchive(file, r.cache)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
 
-						fr.Close()
-					}
-				}
-			} else {
-				rsha, rlength, err := sha1Sum(fullpath)
-				if err != nil && !os.IsNotExist(err) {
-					return err
+	err = walkArchive(reader, r.depth, func(path memberPath, f archiveFile) error {
+		roms, _, err := r.datafile.findROMByCRC(f.Size(), f.CRC())
+		if err != nil {
+			return err
+		}
+
+		// Try again without any copier header
+		crc, size := f.CRC(), f.Size()
+		var payload *headerPayload
+		if len(roms) == 0 {
+			hroms, hpayload, hsum, err := r.findHeaderless(f.Open, f.Size())
+			if err != nil {
+				return err
+			}
+
+			if len(hroms) > 0 {
+				roms = hroms
+				if layoutStripsHeaders(r.layout) {
+					crc, size, payload = hsum.crc, hsum.size, hpayload
 				}
+			}
+		}
 
-				if os.IsNotExist(err) || rsha != rom.SHA1 || rlength != f.UncompressedSize64 {
-					r.logger.Printf("Extracting \"%s\" from \"%s\" to \"%s\"\n", f.Name, file, fullpath)
-					if r.destructive {
-						fr, err := f.Open()
-						if err != nil {
-							return err
-						}
+		for _, rom := range roms {
+			relpath, zipped, name, err := r.exportPath(rom)
+			if err != nil {
+				return err
+			}
 
-						if err := writeFile(fr, fullpath); err != nil {
-							return err
-						}
+			fullpath := filepath.Join(dir, relpath)
 
-						fr.Close()
-					}
+			switch {
+			case relpath == "":
+				// The ROM is stored in another set
+			case zipped:
+				// Archives are written once everything has been found
+				r.zips.add(fullpath, name, zipSource{
+					file:    file,
+					path:    path,
+					payload: payload,
+					crc:     crc,
+					size:    size,
+				})
+			default:
+				// Another worker could be writing to the same path
+				unlock := r.locks.lock(fullpath)
+				err := r.exportArchiveFileToFile(file, path, f, payload, fullpath)
+				unlock()
+				if err != nil {
+					return err
 				}
 			}
 
@@ -447,39 +551,123 @@ func (r *Rombo) exportZip(ctx context.Context, dir, file string) error {
 				return err
 			}
 		}
+
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	reader.Close()
+	closer.Close()
 
 	return nil
 }
 
-func (r *Rombo) verifyZip(ctx context.Context, dir, file string) error {
+func (r *Rombo) plannedZips(ctx context.Context) (<-chan string, <-chan error, error) {
+	out := make(chan string)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(out)
+		defer close(errc)
+		for _, path := range r.zips.paths() {
+			select {
+			case out <- path:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, errc, nil
+}
+
+func (r *Rombo) buildZip(ctx context.Context, dir, file string) error {
+	members := r.zips.members(file)
+
 	reader, err := zip.OpenReader(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	existing := make(map[string]*zip.File)
+	if err == nil {
+		defer reader.Close()
+
+		for _, f := range reader.File {
+			existing[f.Name] = f
+		}
+	} else {
+		reader = nil
+	}
+
+	names := make([]string, 0, len(members))
+	for name := range members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Work out which members are missing or incorrect
+	replace := make(map[string]bool)
+	for _, name := range names {
+		source := members[name]
+		if f, ok := existing[name]; ok && zipCRC(f) == source.crc && f.UncompressedSize64 == source.size {
+			continue
+		}
+
+		replace[name] = true
+
+		if len(source.path) == 0 {
+			r.logger.Printf("Archiving \"%s\" to \"%s\" as \"%s\"\n", source.file, file, name)
+		} else {
+			r.logger.Printf("Extracting \"%s\" from \"%s\" and archiving to \"%s\" as \"%s\"\n", source.path, source.file, file, name)
+		}
+	}
+
+	// Leave the archive untouched if everything is already correct
+	if len(replace) == 0 || !r.destructive {
+		return nil
+	}
+
+	return buildZip(file, layoutZipFormat(r.layout), reader, members, replace)
+}
+
+func (r *Rombo) verifyArchive(ctx context.Context, dir, file string) error {
+	reader, closer, err := openArchive(file, r.cache)
 	if err != nil {
 		return err
 	}
-	defer reader.Close()
+	defer closer.Close()
 
-	for _, f := range reader.File {
-		roms, _, err := r.datafile.findROMByCRC(f.UncompressedSize64, zipCRC(f))
+	err = walkArchive(reader, r.depth, func(_ memberPath, f archiveFile) error {
+		roms, _, err := r.datafile.findROMByCRC(f.Size(), f.CRC())
 		if err != nil {
 			return err
 		}
 
+		// Try again without any copier header
+		if len(roms) == 0 {
+			if roms, _, _, err = r.findHeaderless(f.Open, f.Size()); err != nil {
+				return err
+			}
+		}
+
 		for _, rom := range roms {
 			if err := r.datafile.seenROM(rom); err != nil {
 				return err
 			}
 		}
+
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	reader.Close()
+	closer.Close()
 
 	return nil
 }
 
-func (r *Rombo) zipWorker(ctx context.Context, dir string, f func(context.Context, string, string) error, in <-chan string) (<-chan error, error) {
+func (r *Rombo) archiveWorker(ctx context.Context, dir string, f func(context.Context, string, string) error, in <-chan string) (<-chan error, error) {
 	errc := make(chan error, 1)
 	go func() {
 		defer close(errc)
@@ -535,7 +723,7 @@ func (r *Rombo) Clean(dir string) error {
 	}
 	errcList = append(errcList, errc)
 
-	filec, zipc, errc, err := r.mimeSplitter(ctx, findc)
+	filec, archivec, errc, err := r.mimeSplitter(ctx, findc)
 	if err != nil {
 		return err
 	}
@@ -548,7 +736,7 @@ func (r *Rombo) Clean(dir string) error {
 		}
 		errcList = append(errcList, errc)
 
-		errc, err = r.zipWorker(ctx, dir, r.cleanZip, zipc)
+		errc, err = r.archiveWorker(ctx, dir, r.cleanArchive, archivec)
 		if err != nil {
 			return err
 		}
@@ -580,12 +768,14 @@ func (r *Rombo) Export(dir string, dirs []string) error {
 	}
 	errcList = append(errcList, errc)
 
-	filec, zipc, errc, err := r.mimeSplitter(ctx, mergec)
+	filec, archivec, errc, err := r.mimeSplitter(ctx, mergec)
 	if err != nil {
 		return err
 	}
 	errcList = append(errcList, errc)
 
+	r.zips.reset()
+
 	for i := 0; i < 10; i++ {
 		errc, err := r.fileWorker(ctx, dir, r.exportFile, filec)
 		if err != nil {
@@ -593,7 +783,26 @@ func (r *Rombo) Export(dir string, dirs []string) error {
 		}
 		errcList = append(errcList, errc)
 
-		errc, err = r.zipWorker(ctx, dir, r.exportZip, zipc)
+		errc, err = r.archiveWorker(ctx, dir, r.exportArchive, archivec)
+		if err != nil {
+			return err
+		}
+		errcList = append(errcList, errc)
+	}
+
+	if err := waitForPipeline(errcList...); err != nil {
+		return err
+	}
+
+	// Now every source has been scanned, build each archive in one pass
+	zipc, errc, err := r.plannedZips(ctx)
+	if err != nil {
+		return err
+	}
+	errcList = []<-chan error{errc}
+
+	for i := 0; i < 10; i++ {
+		errc, err := r.archiveWorker(ctx, dir, r.buildZip, zipc)
 		if err != nil {
 			return err
 		}
@@ -625,7 +834,7 @@ func (r *Rombo) Verify(dirs []string) error {
 	}
 	errcList = append(errcList, errc)
 
-	filec, zipc, errc, err := r.mimeSplitter(ctx, mergec)
+	filec, archivec, errc, err := r.mimeSplitter(ctx, mergec)
 	if err != nil {
 		return err
 	}
@@ -638,7 +847,7 @@ func (r *Rombo) Verify(dirs []string) error {
 		}
 		errcList = append(errcList, errc)
 
-		errc, err = r.zipWorker(ctx, "", r.verifyZip, zipc)
+		errc, err = r.archiveWorker(ctx, "", r.verifyArchive, archivec)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,124 @@
+package rombo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"testing"
+)
+
+// countingFile is an archive member that records how many times it has
+// been opened
+type countingFile struct {
+	name  string
+	b     []byte
+	opens int
+}
+
+func (f *countingFile) Name() string {
+	return f.name
+}
+
+func (f *countingFile) Size() uint64 {
+	return uint64(len(f.b))
+}
+
+func (f *countingFile) CRC() string {
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE(f.b))
+}
+
+func (f *countingFile) Open() (io.ReadCloser, error) {
+	f.opens++
+	return ioutil.NopCloser(bytes.NewReader(f.b)), nil
+}
+
+func TestExportArchiveFileToFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []byte
+		opens    int
+	}{
+		{"missing", nil, 1},
+		{"unchanged", []byte("rom"), 0},
+		{"different crc", []byte("ROM"), 1},
+		{"different size", []byte("rom!"), 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fullpath := filepath.Join(t.TempDir(), "a.rom")
+			if tt.existing != nil {
+				if err := ioutil.WriteFile(fullpath, tt.existing, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			r, err := New(NewEmptyDatafile(), log.New(ioutil.Discard, "", 0), true, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			f := &countingFile{name: "a.rom", b: []byte("rom")}
+			if err := r.exportArchiveFileToFile("a.zip", memberPath{f.name}, f, nil, fullpath); err != nil {
+				t.Fatal(err)
+			}
+
+			if f.opens != tt.opens {
+				t.Errorf("member opened %d times, want %d", f.opens, tt.opens)
+			}
+
+			b, err := ioutil.ReadFile(fullpath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, f.b) {
+				t.Errorf("got %q, want %q", b, f.b)
+			}
+		})
+	}
+}
+
+func TestFindFilesSkipsCache(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.rom", ".hidden"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := NewCache(filepath.Join(dir, "rombo.cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.dirty = true
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := New(NewEmptyDatafile(), log.New(ioutil.Discard, "", 0), false, nil, WithCache(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filec, errc, err := r.findFiles(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var files []string
+	for file := range filec {
+		files = append(files, filepath.Base(file))
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 || files[0] != "a.rom" {
+		t.Errorf("got %v, want [a.rom]", files)
+	}
+}
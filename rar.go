@@ -0,0 +1,34 @@
+package rombo
+
+import (
+	"io"
+
+	"github.com/nwaples/rardecode/v2"
+)
+
+type rarIterator struct {
+	*rardecode.Reader
+}
+
+func (r rarIterator) next() (string, error) {
+	for {
+		header, err := r.Next()
+		if err != nil {
+			return "", err
+		}
+
+		if !header.IsDir {
+			return header.Name, nil
+		}
+	}
+}
+
+func newRARReader(r io.ReaderAt, size int64) (*streamReader, error) {
+	return newStreamReader(".rar", func() (streamIterator, error) {
+		reader, err := rardecode.NewReader(io.NewSectionReader(r, 0, size))
+		if err != nil {
+			return nil, err
+		}
+		return rarIterator{reader}, nil
+	}), nil
+}
@@ -5,14 +5,69 @@ import (
 	"log"
 )
 
+// Option configures optional behaviour of a Rombo
+type Option func(*Rombo) error
+
+// WithCache uses c to avoid recomputing the checksums of any files or
+// archive members that haven't changed
+func WithCache(c *Cache) Option {
+	return func(r *Rombo) error {
+		r.cache = c
+		return nil
+	}
+}
+
+// WithDepth descends into archives found within archives, up to depth
+// levels deep. Nested archives are read into memory rather than unpacked
+// to disk
+func WithDepth(depth int) Option {
+	return func(r *Rombo) error {
+		if depth < 0 {
+			return errors.New("depth cannot be negative")
+		}
+		r.depth = depth
+		return nil
+	}
+}
+
+// WithHeaderDirectory looks in dir for the ClrMamePro header detector
+// referenced by the datafile before falling back to the builtin detectors
+func WithHeaderDirectory(dir string) Option {
+	return func(r *Rombo) error {
+		r.headerDir = dir
+		return nil
+	}
+}
+
+// WithSetMode decides how parent and clone sets are stored, the default is
+// NonMerged
+func WithSetMode(mode SetMode) Option {
+	return func(r *Rombo) error {
+		switch mode {
+		case NonMerged, Split, Merged:
+		default:
+			return errors.New("unknown set mode")
+		}
+		r.setMode = mode
+		return nil
+	}
+}
+
 type Rombo struct {
+	cache       *Cache
 	datafile    *Datafile
+	depth       int
 	destructive bool
+	detector    *headerDetector
+	headerDir   string
 	layout      Layout
+	locks       pathLocks
 	logger      *log.Logger
+	setMode     SetMode
+	zips        zipPlan
 }
 
-func New(datafile *Datafile, logger *log.Logger, destructive bool, layout Layout) (*Rombo, error) {
+func New(datafile *Datafile, logger *log.Logger, destructive bool, layout Layout, options ...Option) (*Rombo, error) {
 	if datafile == nil {
 		return nil, errors.New("need a database")
 	}
@@ -31,5 +86,23 @@ func New(datafile *Datafile, logger *log.Logger, destructive bool, layout Layout
 		layout:      l,
 		logger:      logger,
 	}
+
+	for _, option := range options {
+		if err := option(&rombo); err != nil {
+			return nil, err
+		}
+	}
+
+	if name := datafile.headerName(); name != "" {
+		detector, err := loadHeaderDetector(name, rombo.headerDir)
+		if err != nil {
+			return nil, err
+		}
+		if detector == nil {
+			logger.Printf("No header detector \"%s\", only matching ROMs with any header intact\n", name)
+		}
+		rombo.detector = detector
+	}
+
 	return &rombo, nil
 }
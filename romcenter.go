@@ -0,0 +1,212 @@
+package rombo
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	rcSeparator = "\u00ac" // NOT SIGN
+)
+
+func rcGame(document *datDocument, games map[string]*datGame, fields []string) error {
+	// ¬parent name¬parent description¬game name¬game description¬rom name¬rom crc¬rom size¬romof name¬merge name¬
+	if len(fields) < 9 {
+		return fmt.Errorf("expected 9 fields, got %d", len(fields))
+	}
+
+	game, ok := games[fields[2]]
+	if !ok {
+		game = &datGame{
+			Name:        fields[2],
+			Description: fields[3],
+		}
+		if fields[0] != fields[2] {
+			game.CloneOf = fields[0]
+		}
+		game.RomOf = fields[7]
+
+		games[game.Name] = game
+		document.Games = append(document.Games, game)
+	}
+
+	size, err := strconv.ParseUint(fields[6], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	game.ROMs = append(game.ROMs, &datROM{
+		Name:  fields[4],
+		CRC:   fields[5],
+		Size:  size,
+		Merge: fields[8],
+	})
+
+	return nil
+}
+
+func rcParse(b []byte) (*datDocument, error) {
+	b = bytes.TrimPrefix(b, []byte("\xef\xbb\xbf"))
+
+	// Older dats are written in Latin-1 so the separator is a single byte
+	if !utf8.Valid(b) {
+		b = latin1ToUTF8(b)
+	}
+
+	document := datDocument{
+		Header: &datHeader{},
+	}
+	games := make(map[string]*datGame)
+
+	var section string
+	var split, merge bool
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToUpper(line[1 : len(line)-1])
+			continue
+		}
+
+		if section == "GAMES" {
+			fields := strings.Split(strings.TrimSuffix(strings.TrimPrefix(line, rcSeparator), rcSeparator), rcSeparator)
+			if err := rcGame(&document, games, fields); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, value := strings.ToLower(kv[0]), kv[1]
+
+		switch section {
+		case "CREDITS":
+			switch key {
+			case "author":
+				document.Header.Author = value
+			case "version":
+				document.Header.Version = value
+			case "email":
+				document.Header.Email = value
+			case "homepage":
+				document.Header.Homepage = value
+			case "url":
+				document.Header.URL = value
+			case "date":
+				document.Header.Date = value
+			case "comment":
+				document.Header.Comment = value
+			}
+		case "DAT":
+			switch key {
+			case "split":
+				split = value == "1"
+			case "merge":
+				merge = value == "1"
+			}
+		case "EMULATOR":
+			switch key {
+			case "refname":
+				document.Header.Name = value
+			case "version":
+				document.Header.Description = value
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case merge:
+		document.Header.ClrMamePro = &datClrMamePro{ForceMerging: "full"}
+	case split:
+		document.Header.ClrMamePro = &datClrMamePro{ForceMerging: "split"}
+	}
+
+	return &document, nil
+}
+
+func rcMarshal(document *datDocument) []byte {
+	buf := new(bytes.Buffer)
+
+	header := document.Header
+	if header == nil {
+		header = &datHeader{}
+	}
+
+	var split, merge int
+	if header.ClrMamePro != nil {
+		switch header.ClrMamePro.ForceMerging {
+		case "full":
+			merge = 1
+		case "split":
+			split = 1
+		}
+	}
+
+	buf.WriteString("[CREDITS]\n")
+	fmt.Fprintf(buf, "author=%s\n", header.Author)
+	fmt.Fprintf(buf, "version=%s\n", header.Version)
+	fmt.Fprintf(buf, "email=%s\n", header.Email)
+	fmt.Fprintf(buf, "homepage=%s\n", header.Homepage)
+	fmt.Fprintf(buf, "url=%s\n", header.URL)
+	fmt.Fprintf(buf, "date=%s\n", header.Date)
+	fmt.Fprintf(buf, "comment=%s\n", header.Comment)
+	buf.WriteString("[DAT]\n")
+	buf.WriteString("version=2.50\n")
+	fmt.Fprintf(buf, "split=%d\n", split)
+	fmt.Fprintf(buf, "merge=%d\n", merge)
+	buf.WriteString("[EMULATOR]\n")
+	fmt.Fprintf(buf, "refname=%s\n", header.Name)
+	fmt.Fprintf(buf, "version=%s\n", header.Description)
+	buf.WriteString("[GAMES]\n")
+
+	descriptions := make(map[string]string, len(document.Games))
+	for _, game := range document.Games {
+		descriptions[game.Name] = game.Description
+	}
+
+	for _, game := range document.Games {
+		parent := game.Name
+		if game.CloneOf != "" {
+			parent = game.CloneOf
+		}
+		description, ok := descriptions[parent]
+		if !ok {
+			description = parent
+		}
+
+		for _, rom := range game.ROMs {
+			fields := []string{
+				parent,
+				description,
+				game.Name,
+				game.Description,
+				rom.Name,
+				rom.CRC,
+				strconv.FormatUint(rom.Size, 10),
+				game.RomOf,
+				rom.Merge,
+			}
+			buf.WriteString(rcSeparator + strings.Join(fields, rcSeparator) + rcSeparator + "\n")
+		}
+	}
+
+	return buf.Bytes()
+}
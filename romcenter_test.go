@@ -0,0 +1,101 @@
+package rombo
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const rcDatafile = `[CREDITS]
+author=Someone
+version=1.0
+comment=Test
+[DAT]
+version=2.50
+split=0
+merge=1
+[EMULATOR]
+refname=Test
+version=Test Collection
+[GAMES]
+¬parent¬Parent Game¬parent¬Parent Game¬a.rom¬0a1b2c3d¬1024¬¬¬
+¬parent¬Parent Game¬parent¬Parent Game¬b.rom¬00000002¬2048¬¬¬
+¬parent¬Parent Game¬clone¬Clone Game¬a.rom¬0a1b2c3d¬1024¬parent¬a.rom¬
+¬parent¬Parent Game¬clone¬Clone Game¬c.rom¬00000003¬512¬parent¬¬
+`
+
+func TestRCParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{"utf-8", []byte(rcDatafile)},
+		{"latin-1", []byte(strings.ReplaceAll(rcDatafile, rcSeparator, "\xac"))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := NewDatafile(tt.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if d.Format() != RomCenter {
+				t.Fatalf("got format %d, want %d", d.Format(), RomCenter)
+			}
+
+			if d.header.Name != "Test" || d.header.Description != "Test Collection" || d.header.Author != "Someone" {
+				t.Errorf("unexpected header %+v", d.header)
+			}
+			if d.header.ClrMamePro == nil || d.header.ClrMamePro.ForceMerging != "full" {
+				t.Errorf("unexpected clrmamepro header %+v", d.header.ClrMamePro)
+			}
+
+			if len(d.games) != 2 {
+				t.Fatalf("got %d games, want 2", len(d.games))
+			}
+
+			parent, clone := d.games[0], d.games[1]
+			if parent.CloneOf != "" || len(parent.ROMs) != 2 || parent.ROMs[1].Size != 2048 {
+				t.Errorf("unexpected parent %+v", parent)
+			}
+			if clone.CloneOf != "parent" || clone.RomOf != "parent" || len(clone.ROMs) != 2 || clone.ROMs[0].Merge != "a.rom" {
+				t.Errorf("unexpected clone %+v", clone)
+			}
+		})
+	}
+}
+
+func TestRCParseErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"too few fields", "[GAMES]\n¬parent¬Parent¬parent¬Parent¬a.rom¬00000001¬\n"},
+		{"bad size", "[GAMES]\n¬parent¬Parent¬parent¬Parent¬a.rom¬00000001¬big¬¬¬\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := rcParse([]byte(tt.input)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestRCMarshalRoundTrip(t *testing.T) {
+	document, err := rcParse([]byte(rcDatafile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := rcParse(rcMarshal(document))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(document, again) {
+		t.Errorf("got %+v, want %+v", again, document)
+	}
+}
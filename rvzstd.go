@@ -0,0 +1,304 @@
+package rombo
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	zipMethodZstd = 93
+
+	rvzstdPrefix = "RVZSTD-"
+
+	zipEOCDLen                = 22
+	zip64EOCDLen              = 56
+	zip64EOCDLocatorLen       = 20
+	zipEOCDSignature          = 0x06054b50
+	zip64EOCDSignature        = 0x06064b50
+	zip64EOCDLocatorSignature = 0x07064b50
+)
+
+func init() {
+	// Allow any zstd-compressed zip to be read, not just our own
+	zip.RegisterDecompressor(zipMethodZstd, func(r io.Reader) io.ReadCloser {
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return ioutil.NopCloser(errReader{err})
+		}
+		return zr.IOReadCloser()
+	})
+}
+
+type errReader struct {
+	err error
+}
+
+func (e errReader) Read([]byte) (int, error) {
+	return 0, e.err
+}
+
+type rvzstdMember struct {
+	name    string
+	file    *os.File
+	crc     hash.Hash32
+	size    uint64
+	encoder *zstd.Encoder
+}
+
+func (m *rvzstdMember) Write(p []byte) (int, error) {
+	n, err := m.encoder.Write(p)
+	m.crc.Write(p[:n])
+	m.size += uint64(n)
+	return n, err
+}
+
+// rvzstdTail captures everything written after the last member, which is
+// the central directory and end of central directory records, so that the
+// comment can be set to the CRC of the central directory
+type rvzstdTail struct {
+	w       io.Writer
+	buf     bytes.Buffer
+	capture bool
+}
+
+func (t *rvzstdTail) Write(p []byte) (int, error) {
+	if t.capture {
+		return t.buf.Write(p)
+	}
+	return t.w.Write(p)
+}
+
+// rvzstdWriter writes deterministic zstd-compressed zip archives using the
+// same RVZSTD structure as RomVault. Like torrentzip, members are sorted
+// by name regardless of the order they're created
+type rvzstdWriter struct {
+	tail    *rvzstdTail
+	w       *zip.Writer
+	members []*rvzstdMember
+	current *rvzstdMember
+}
+
+func newRVZSTDWriter(w io.Writer) (*rvzstdWriter, error) {
+	tail := &rvzstdTail{w: w}
+
+	return &rvzstdWriter{
+		tail: tail,
+		w:    zip.NewWriter(tail),
+	}, nil
+}
+
+func (w *rvzstdWriter) finish() error {
+	if w.current == nil {
+		return nil
+	}
+
+	err := w.current.encoder.Close()
+	w.current = nil
+
+	return err
+}
+
+func (w *rvzstdWriter) Create(name string) (io.Writer, error) {
+	if err := w.finish(); err != nil {
+		return nil, err
+	}
+
+	// Compressed data is held in a temporary file until every member is
+	// known as some can be quite large
+	f, err := ioutil.TempFile("", "rvzstd")
+	if err != nil {
+		return nil, err
+	}
+
+	member := &rvzstdMember{
+		name: name,
+		file: f,
+		crc:  crc32.NewIEEE(),
+	}
+	w.members = append(w.members, member)
+
+	member.encoder, err = zstd.NewWriter(f, zstd.WithEncoderLevel(zstd.SpeedBestCompression), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	w.current = member
+
+	return member, nil
+}
+
+func (w *rvzstdWriter) cleanup() {
+	for _, m := range w.members {
+		m.file.Close()
+		os.Remove(m.file.Name())
+	}
+	w.members = nil
+}
+
+func (w *rvzstdWriter) writeMember(m *rvzstdMember) error {
+	info, err := m.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if _, err := m.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	// Leave the timestamps zeroed and avoid any extra fields or data
+	// descriptors so the archive only depends on its contents
+	fw, err := w.w.CreateRaw(&zip.FileHeader{
+		Name:               m.name,
+		Method:             zipMethodZstd,
+		CRC32:              m.crc.Sum32(),
+		CompressedSize64:   uint64(info.Size()),
+		UncompressedSize64: m.size,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(fw, m.file)
+	return err
+}
+
+func (w *rvzstdWriter) Close() error {
+	defer w.cleanup()
+
+	if err := w.finish(); err != nil {
+		return err
+	}
+
+	sort.SliceStable(w.members, func(i, j int) bool {
+		return strings.ToLower(w.members[i].name) < strings.ToLower(w.members[j].name)
+	})
+
+	for _, m := range w.members {
+		if err := w.writeMember(m); err != nil {
+			return err
+		}
+	}
+
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+
+	// Write the central directory with a placeholder comment
+	w.tail.capture = true
+	if err := w.w.SetComment(fmt.Sprintf("%s%08X", rvzstdPrefix, 0)); err != nil {
+		return err
+	}
+	if err := w.w.Close(); err != nil {
+		return err
+	}
+
+	b := w.tail.buf.Bytes()
+	eocd := len(b) - zipEOCDLen - len(rvzstdPrefix) - crc32.Size<<1
+	directory := eocd
+	if locator := eocd - zip64EOCDLocatorLen - zip64EOCDLen; locator >= 0 && binary.LittleEndian.Uint32(b[locator:]) == zip64EOCDSignature {
+		directory = locator
+	}
+
+	copy(b[len(b)-crc32.Size<<1:], fmt.Sprintf("%08X", crc32.ChecksumIEEE(b[:directory])))
+
+	_, err := w.tail.w.Write(b)
+	return err
+}
+
+// rvzstdDirectory returns the offset and size of the central directory
+// from the end of central directory records at the end of b, which holds
+// the last part of the archive starting at offset base
+func rvzstdDirectory(b []byte, base int64) (int64, int64, bool) {
+	eocd := len(b) - zipEOCDLen - len(rvzstdPrefix) - crc32.Size<<1
+	if eocd < 0 || binary.LittleEndian.Uint32(b[eocd:]) != zipEOCDSignature {
+		return 0, 0, false
+	}
+
+	size := int64(binary.LittleEndian.Uint32(b[eocd+12:]))
+	offset := int64(binary.LittleEndian.Uint32(b[eocd+16:]))
+	if size != 0xffffffff && offset != 0xffffffff {
+		return offset, size, true
+	}
+
+	locator := eocd - zip64EOCDLocatorLen
+	if locator < 0 || binary.LittleEndian.Uint32(b[locator:]) != zip64EOCDLocatorSignature {
+		return 0, 0, false
+	}
+
+	record := int64(binary.LittleEndian.Uint64(b[locator+8:])) - base
+	if record < 0 || record+zip64EOCDLen > int64(len(b)) || binary.LittleEndian.Uint32(b[record:]) != zip64EOCDSignature {
+		return 0, 0, false
+	}
+
+	return int64(binary.LittleEndian.Uint64(b[record+48:])), int64(binary.LittleEndian.Uint64(b[record+40:])), true
+}
+
+// isRVZSTD checks the structure of the zip archive file rather than its
+// exact bytes, as archives written by RomVault use a different zstd
+// encoder. The comment must be the CRC of the central directory, and every
+// member must be zstd-compressed with zeroed timestamps and sorted by name
+func isRVZSTD(file string) (bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	// The comment has a fixed length so the end of central directory
+	// records are always in the same place
+	tail := int64(zipEOCDLen + len(rvzstdPrefix) + crc32.Size<<1 + zip64EOCDLocatorLen + zip64EOCDLen)
+	if tail > info.Size() {
+		tail = info.Size()
+	}
+
+	b := make([]byte, tail)
+	if _, err := f.ReadAt(b, info.Size()-tail); err != nil {
+		return false, err
+	}
+
+	offset, size, ok := rvzstdDirectory(b, info.Size()-tail)
+	if !ok || offset+size > info.Size() {
+		return false, nil
+	}
+
+	directory := make([]byte, size)
+	if _, err := f.ReadAt(directory, offset); err != nil {
+		return false, err
+	}
+
+	if comment := string(b[len(b)-len(rvzstdPrefix)-crc32.Size<<1:]); comment != fmt.Sprintf("%s%08X", rvzstdPrefix, crc32.ChecksumIEEE(directory)) {
+		return false, nil
+	}
+
+	reader, err := zip.NewReader(f, info.Size())
+	if err != nil {
+		return false, nil
+	}
+
+	for i, zf := range reader.File {
+		if zf.Method != zipMethodZstd || zf.ModifiedTime != 0 || zf.ModifiedDate != 0 {
+			return false, nil
+		}
+
+		if i > 0 && strings.ToLower(reader.File[i-1].Name) > strings.ToLower(zf.Name) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
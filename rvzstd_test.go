@@ -0,0 +1,159 @@
+package rombo
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testdata/rvzstd.zip has the RVZSTD structure but was compressed with
+// different zstd settings, so it isn't byte-identical to what
+// rvzstdWriter produces for the same members
+const rvzstdFixture = "testdata/rvzstd.zip"
+
+const rvzstdFixtureDatafile = `<datafile>
+	<header>
+		<name>RVZSTD</name>
+	</header>
+	<game name="rvzstd">
+		<description>rvzstd</description>
+		<rom name="a.bin" size="44" crc="6d93c138"/>
+		<rom name="B.bin" size="82" crc="3026cf17"/>
+		<rom name="c.bin" size="37" crc="784883d1"/>
+	</game>
+</datafile>`
+
+func writeTestZip(t *testing.T, file string, write func(zipWriter) error, writer func(*os.File) (zipWriter, error)) {
+	t.Helper()
+
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	zw, err := writer(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := write(zw); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIsRVZSTD(t *testing.T) {
+	dir := t.TempDir()
+
+	members := func(zw zipWriter) error {
+		for _, name := range []string{"b.bin", "A.bin"} {
+			if err := copyZipMember(zw, name, bytes.NewReader([]byte(name))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	ours := filepath.Join(dir, "ours.zip")
+	writeTestZip(t, ours, members, func(f *os.File) (zipWriter, error) {
+		return newRVZSTDWriter(f)
+	})
+
+	deflate := filepath.Join(dir, "deflate.zip")
+	writeTestZip(t, deflate, members, func(f *os.File) (zipWriter, error) {
+		return zip.NewWriter(f), nil
+	})
+
+	b, err := ioutil.ReadFile(rvzstdFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	comment := filepath.Join(dir, "comment.zip")
+	bad := append([]byte{}, b...)
+	bad[len(bad)-1] ^= 1
+	if err := ioutil.WriteFile(comment, bad, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		file string
+		want bool
+	}{
+		{"fixture", rvzstdFixture, true},
+		{"rvzstdWriter", ours, true},
+		{"deflate", deflate, false},
+		{"wrong comment", comment, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := isRVZSTD(tt.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCleanKeepsRVZSTD(t *testing.T) {
+	b, err := ioutil.ReadFile(rvzstdFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, filepath.Base(rvzstdFixture))
+	if err := ioutil.WriteFile(file, b, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	// Make sure the fixture really would be replaced if it was compared
+	// byte for byte
+	sum, err := checksumFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpfile, sha, err := recreateZip(file, rvzstdZip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(tmpfile)
+	if sum.sha1 == sha {
+		t.Fatal("fixture is identical to a recreated archive")
+	}
+
+	d, err := NewDatafile([]byte(rvzstdFixtureDatafile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := New(d, log.New(ioutil.Discard, "", 0), true, SimpleZstd{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Clean(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, b) {
+		t.Error("archive was replaced")
+	}
+}
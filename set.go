@@ -0,0 +1,91 @@
+package rombo
+
+// SetMode decides which archive the ROMs of parent and clone sets go into
+type SetMode int
+
+const (
+	NonMerged SetMode = iota // Every set contains all of its ROMs
+	Split                    // Sets don't contain ROMs found in their parent or BIOS set
+	Merged                   // Clones are stored with their parent
+)
+
+// setROM returns rom as it should be exported for the set mode, or false if
+// the ROM belongs in another set
+func (r *Rombo) setROM(rom ROM) (ROM, bool) {
+	switch r.setMode {
+	case Split:
+		if rom.Merge != "" {
+			return rom, false
+		}
+	case Merged:
+		if rom.Merge != "" {
+			return rom, false
+		}
+		if rom.CloneOf != "" {
+			rom.Filename = r.datafile.mergedFilename(rom)
+			rom.Game = r.datafile.parent(rom.Game)
+		}
+	}
+
+	return rom, true
+}
+
+// sameDump reports whether a and b could be the same dump, every hash
+// known for both must match
+func sameDump(a *datROM, b ROM) bool {
+	switch {
+	case a.Size != b.Size:
+		return false
+	case a.CRC != "" && b.CRC != "" && a.CRC != b.CRC:
+		return false
+	case a.MD5 != "" && b.MD5 != "" && a.MD5 != b.MD5:
+		return false
+	case a.SHA1 != "" && b.SHA1 != "" && a.SHA1 != b.SHA1:
+		return false
+	}
+	return true
+}
+
+// mergedFilename returns the name of the clone ROM within the merged set of
+// its parent. A ROM that differs from another of the same name stored in the
+// set is kept in a directory named after its own game, as ClrMamePro does
+func (d *Datafile) mergedFilename(rom ROM) string {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	clash := rom.Game + "/" + rom.Filename
+
+	for _, game := range d.groups[d.parentLocked(rom.Game)] {
+		if game.Name == rom.Game {
+			continue
+		}
+
+		if rom.Disk {
+			for _, disk := range game.Disks {
+				if disk.filename() == rom.Filename && !d.mergeable(game.CloneOf, game.RomOf, disk.Merge) && disk.SHA1 != rom.SHA1 {
+					return clash
+				}
+			}
+			continue
+		}
+
+		for _, r := range game.ROMs {
+			if r.Name == rom.Filename && !d.mergeable(game.CloneOf, game.RomOf, r.Merge) && !sameDump(r, rom) {
+				return clash
+			}
+		}
+	}
+
+	return rom.Filename
+}
+
+// exportPath returns where rom is exported according to the layout and set
+// mode, the path is empty if the ROM is stored in another set
+func (r *Rombo) exportPath(rom ROM) (string, bool, string, error) {
+	rom, ok := r.setROM(rom)
+	if !ok {
+		return "", false, "", nil
+	}
+
+	return r.layout.exportPath(rom)
+}
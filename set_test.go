@@ -0,0 +1,77 @@
+package rombo
+
+import (
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+const setDatafile = `<datafile>
+	<header>
+		<name>Sets</name>
+	</header>
+	<machine name="parent">
+		<description>Parent</description>
+		<rom name="a.rom" size="1" crc="00000001"/>
+		<rom name="b.rom" size="1" crc="00000002"/>
+	</machine>
+	<machine name="clone" cloneof="parent" romof="parent">
+		<description>Clone</description>
+		<rom name="a.rom" size="1" crc="00000001" merge="a.rom"/>
+		<rom name="b.rom" size="1" crc="00000003"/>
+		<rom name="c.rom" size="1" crc="00000004"/>
+	</machine>
+	<machine name="orphan" cloneof="missing" romof="missing">
+		<description>Orphan</description>
+		<rom name="d.rom" size="1" crc="00000005" merge="d.rom"/>
+	</machine>
+</datafile>`
+
+func TestSetModeExportPath(t *testing.T) {
+	tests := []struct {
+		mode SetMode
+		crc  string
+		want string // Empty if stored in another set
+		name string
+	}{
+		{NonMerged, "00000001", "clone.zip", "a.rom"},
+		{Split, "00000001", "", ""},
+		{Split, "00000003", "clone.zip", "b.rom"},
+		{Merged, "00000003", "parent.zip", "clone/b.rom"},
+		{Merged, "00000004", "parent.zip", "c.rom"},
+		{Split, "00000005", "orphan.zip", "d.rom"},
+		{Merged, "00000005", "orphan.zip", "d.rom"},
+	}
+
+	d, err := NewDatafile([]byte(setDatafile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		r, err := New(d, log.New(ioutil.Discard, "", 0), false, nil, WithSetMode(tt.mode))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		roms, _, err := d.findROMByCRC(1, tt.crc)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var rom ROM
+		for _, rom = range roms {
+			if rom.Game != "parent" {
+				break
+			}
+		}
+
+		path, _, name, err := r.exportPath(rom)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path != tt.want || name != tt.name {
+			t.Errorf("%s in %s with set mode %d: got %q %q, want %q %q", rom.Filename, rom.Game, tt.mode, path, name, tt.want, tt.name)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package rombo
+
+import (
+	"bytes"
+	"encoding/xml"
+)
+
+type slDataArea struct {
+	Name string    `xml:"name,attr"`
+	ROMs []*datROM `xml:"rom"`
+}
+
+type slDiskArea struct {
+	Name  string     `xml:"name,attr"`
+	Disks []*datDisk `xml:"disk"`
+}
+
+type slPart struct {
+	Name      string       `xml:"name,attr"`
+	Interface string       `xml:"interface,attr"`
+	DataAreas []slDataArea `xml:"dataarea"`
+	DiskAreas []slDiskArea `xml:"diskarea"`
+}
+
+type slSoftware struct {
+	Name        string   `xml:"name,attr"`
+	CloneOf     string   `xml:"cloneof,attr"`
+	Description string   `xml:"description"`
+	Year        string   `xml:"year"`
+	Publisher   string   `xml:"publisher"`
+	Parts       []slPart `xml:"part"`
+}
+
+type slSoftwareList struct {
+	XMLName     xml.Name     `xml:"softwarelist"`
+	Name        string       `xml:"name,attr"`
+	Description string       `xml:"description,attr"`
+	Software    []slSoftware `xml:"software"`
+}
+
+// slParse reads a MAME software list, each piece of software becomes a game
+// containing the ROMs and disks from all of its parts
+func slParse(b []byte) (*datDocument, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(b))
+	decoder.CharsetReader = charsetReader
+
+	list := slSoftwareList{}
+	if err := decoder.Decode(&list); err != nil {
+		return nil, err
+	}
+
+	document := datDocument{
+		Header: &datHeader{
+			Name:        list.Name,
+			Description: list.Description,
+		},
+		Games: make([]*datGame, 0, len(list.Software)),
+	}
+
+	for _, software := range list.Software {
+		game := datGame{
+			Name:         software.Name,
+			CloneOf:      software.CloneOf,
+			RomOf:        software.CloneOf,
+			Description:  software.Description,
+			Year:         software.Year,
+			Manufacturer: software.Publisher,
+			SoftwareList: list.Name,
+		}
+
+		for _, part := range software.Parts {
+			for _, area := range part.DataAreas {
+				for _, rom := range area.ROMs {
+					// Unnamed entries just describe how the
+					// previous ROM is loaded
+					if rom.Name == "" {
+						continue
+					}
+					game.ROMs = append(game.ROMs, rom)
+				}
+			}
+			for _, area := range part.DiskAreas {
+				game.Disks = append(game.Disks, area.Disks...)
+			}
+		}
+
+		document.Games = append(document.Games, &game)
+	}
+
+	return &document, nil
+}
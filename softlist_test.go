@@ -0,0 +1,141 @@
+package rombo
+
+import (
+	"reflect"
+	"testing"
+)
+
+const slDatafile = `<?xml version="1.0"?>
+<!DOCTYPE softwarelist [
+<!ELEMENT softwarelist (notes?, software+)>
+	<!ATTLIST softwarelist name CDATA #REQUIRED>
+]>
+<softwarelist name="nes" description="Nintendo Entertainment System cartridges">
+	<software name="smb">
+		<description>Super Mario Bros.</description>
+		<year>1985</year>
+		<publisher>Nintendo</publisher>
+		<part name="cart" interface="nes_cart">
+			<feature name="slot" value="nrom"/>
+			<dataarea name="prg" size="32768">
+				<rom name="smb.prg" size="32768" crc="5cf548d3" sha1="ab9d4d0b7c6c6d0b7e3ef5b3d7b3a3e3b61c0d9e" offset="00000"/>
+			</dataarea>
+			<dataarea name="chr" size="8192">
+				<rom name="smb.chr" size="4096" crc="867b51ad" offset="00000"/>
+				<rom size="4096" offset="0x1000" loadflag="reload"/>
+			</dataarea>
+		</part>
+	</software>
+	<software name="smbj" cloneof="smb">
+		<description>Super Mario Bros. (Japan)</description>
+		<year>1985</year>
+		<publisher>Nintendo</publisher>
+		<part name="flop1" interface="floppy_5_25">
+			<dataarea name="flop" size="65500">
+				<rom name="smbj side a.fds" size="65500" crc="00000001"/>
+			</dataarea>
+		</part>
+		<part name="cdrom" interface="cdrom">
+			<diskarea name="cdrom">
+				<disk name="smbj disc" sha1="0123456789abcdef0123456789abcdef01234567"/>
+			</diskarea>
+		</part>
+	</software>
+</softwarelist>`
+
+func TestSLParse(t *testing.T) {
+	d, err := NewDatafile([]byte(slDatafile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d.Format() != SoftwareList {
+		t.Fatalf("got format %d, want %d", d.Format(), SoftwareList)
+	}
+
+	if d.header.Name != "nes" || d.header.Description != "Nintendo Entertainment System cartridges" {
+		t.Errorf("unexpected header %+v", d.header)
+	}
+
+	if len(d.games) != 2 {
+		t.Fatalf("got %d games, want 2", len(d.games))
+	}
+
+	parent, clone := d.games[0], d.games[1]
+	if parent.Manufacturer != "Nintendo" || parent.Year != "1985" || parent.SoftwareList != "nes" {
+		t.Errorf("unexpected parent %+v", parent)
+	}
+	if len(parent.ROMs) != 2 || parent.ROMs[1].Name != "smb.chr" {
+		t.Errorf("got %d ROMs in parent, want 2", len(parent.ROMs))
+	}
+	if clone.CloneOf != "smb" || clone.RomOf != "smb" || len(clone.ROMs) != 1 || len(clone.Disks) != 1 {
+		t.Errorf("unexpected clone %+v", clone)
+	}
+
+	roms, _, err := d.findROMByCRC(4096, "867b51ad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roms) != 1 || roms[0].SoftwareList != "nes" {
+		t.Errorf("unexpected ROMs %+v", roms)
+	}
+}
+
+func TestSLMarshal(t *testing.T) {
+	d, err := NewDatafile([]byte(slDatafile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Software lists are always written back out as Logiqx XML
+	if _, err := d.Fixdat(SoftwareList, false); err == nil {
+		t.Error("expected an error writing a software list")
+	}
+
+	other, err := NewDatafile(d.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if other.Format() != Logiqx {
+		t.Fatalf("got format %d, want %d", other.Format(), Logiqx)
+	}
+
+	for i, game := range d.games {
+		got := other.games[i]
+		if got.Name != game.Name || got.CloneOf != game.CloneOf || got.Description != game.Description || got.SoftwareList != "nes" {
+			t.Errorf("got game %+v, want %+v", got, game)
+		}
+		if !reflect.DeepEqual(got.ROMs, game.ROMs) {
+			t.Errorf("got ROMs %+v, want %+v", got.ROMs, game.ROMs)
+		}
+		if !reflect.DeepEqual(got.Disks, game.Disks) {
+			t.Errorf("got disks %+v, want %+v", got.Disks, game.Disks)
+		}
+	}
+
+	roms, _, err := other.findROMByCRC(4096, "867b51ad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roms) != 1 || roms[0].SoftwareList != "nes" {
+		t.Errorf("unexpected ROMs %+v", roms)
+	}
+
+	// A fixdat of the missing software keeps the software list too
+	b, err := d.Fixdat(Logiqx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fixdat, err := NewDatafile(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, game := range fixdat.games {
+		if game.SoftwareList != "nes" {
+			t.Errorf("%s: got software list %q, want %q", game.Name, game.SoftwareList, "nes")
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package rombo
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// streamIterator walks the members of an archive that can only be read
+// sequentially
+type streamIterator interface {
+	io.Reader
+	// next advances to the next regular file and returns its name, or
+	// io.EOF when there are no more
+	next() (string, error)
+}
+
+type streamFile struct {
+	r     *streamReader
+	index int
+	name  string
+	sum   checksum
+}
+
+func (f streamFile) Name() string {
+	return f.name
+}
+
+func (f streamFile) Size() uint64 {
+	return f.sum.size
+}
+
+func (f streamFile) CRC() string {
+	return f.sum.crc
+}
+
+func (f streamFile) Open() (io.ReadCloser, error) {
+	// Start from the beginning and skip to the member
+	it, err := f.r.open()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; ; i++ {
+		name, err := it.next()
+		if err != nil {
+			if err == io.EOF {
+				return nil, errors.New("archive member not found")
+			}
+			return nil, err
+		}
+
+		if i == f.index || (f.index < 0 && name == f.name) {
+			return ioutil.NopCloser(it), nil
+		}
+	}
+}
+
+type streamReader struct {
+	format string
+	open   func() (streamIterator, error)
+	files  []archiveFile
+}
+
+func newStreamReader(format string, open func() (streamIterator, error)) *streamReader {
+	return &streamReader{
+		format: format,
+		open:   open,
+	}
+}
+
+// scan reads the whole archive up front as sequential formats don't record
+// the CRC of each member in a way that's exposed without decompressing it.
+// Any member with a checksum in the cache isn't checksummed again
+func (s *streamReader) scan(cache *memberCache) error {
+	it, err := s.open()
+	if err != nil {
+		return err
+	}
+
+	for {
+		name, err := it.next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+
+		sum, ok := cache.lookup(name)
+		if !ok {
+			if sum, err = checksumReader(it); err != nil {
+				return err
+			}
+			cache.store(name, sum)
+		}
+
+		s.files = append(s.files, streamFile{
+			r:     s,
+			index: len(s.files),
+			name:  name,
+			sum:   sum,
+		})
+	}
+
+	return nil
+}
+
+// member returns the first member called name without scanning the
+// archive, so the size and CRC are unknown
+func (s *streamReader) member(name string) archiveFile {
+	return streamFile{
+		r:     s,
+		index: -1,
+		name:  name,
+	}
+}
+
+func (s *streamReader) Format() string {
+	return s.format
+}
+
+func (s *streamReader) Files() []archiveFile {
+	return s.files
+}
@@ -0,0 +1,114 @@
+package rombo
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testMember struct {
+	name string
+	b    []byte
+}
+
+// testIterator is a sequential archive that counts how much of it has been
+// read
+type testIterator struct {
+	members []testMember
+	index   int
+	r       *bytes.Reader
+	read    *int
+}
+
+func (it *testIterator) next() (string, error) {
+	if it.index >= len(it.members) {
+		return "", io.EOF
+	}
+	m := it.members[it.index]
+	it.index++
+	it.r = bytes.NewReader(m.b)
+	return m.name, nil
+}
+
+func (it *testIterator) Read(p []byte) (int, error) {
+	n, err := it.r.Read(p)
+	*it.read += n
+	return n, err
+}
+
+func TestStreamReaderScan(t *testing.T) {
+	members := []testMember{
+		{"a.rom", []byte("first")},
+		{"b.rom", []byte("second")},
+	}
+
+	var read int
+	open := func() (streamIterator, error) {
+		return &testIterator{members: members, read: &read}, nil
+	}
+
+	file := filepath.Join(t.TempDir(), "a.tar")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewCache(filepath.Join(t.TempDir(), "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []int{len("first") + len("second"), 0} {
+		read = 0
+
+		s := newStreamReader("tar", open)
+		if err := s.scan(newMemberCache(c, file, info)); err != nil {
+			t.Fatal(err)
+		}
+
+		// The second scan only walks the member names
+		if read != want {
+			t.Errorf("scan %d read %d bytes, want %d", i, read, want)
+		}
+
+		files := s.Files()
+		if len(files) != len(members) {
+			t.Fatalf("got %d files, want %d", len(files), len(members))
+		}
+
+		for j, f := range files {
+			if f.Name() != members[j].name || f.Size() != uint64(len(members[j].b)) {
+				t.Errorf("got %s with size %d", f.Name(), f.Size())
+			}
+
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, members[j].b) {
+				t.Errorf("got %q, want %q", b, members[j].b)
+			}
+		}
+	}
+
+	// A member opened by name doesn't need a scan
+	rc, err := newStreamReader("tar", open).member("b.rom").Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if b, _ := ioutil.ReadAll(rc); string(b) != "second" {
+		t.Errorf("got %q, want second", b)
+	}
+}
@@ -0,0 +1,101 @@
+package rombo
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	tarMagicOffset = 257
+)
+
+type tarIterator struct {
+	*tar.Reader
+}
+
+func (t tarIterator) next() (string, error) {
+	for {
+		header, err := t.Next()
+		if err != nil {
+			return "", err
+		}
+
+		if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA {
+			return header.Name, nil
+		}
+	}
+}
+
+// gzipIterator presents a gzip stream as an archive with a single member
+type gzipIterator struct {
+	*gzip.Reader
+	name string
+	done bool
+}
+
+func (g *gzipIterator) next() (string, error) {
+	if g.done {
+		return "", io.EOF
+	}
+	g.done = true
+	return g.name, nil
+}
+
+func newTarReader(r io.ReaderAt, size int64) (*streamReader, error) {
+	return newStreamReader(".tar", func() (streamIterator, error) {
+		return tarIterator{tar.NewReader(io.NewSectionReader(r, 0, size))}, nil
+	}), nil
+}
+
+// isTar checks for the ustar magic used by both POSIX and GNU tar
+func isTar(b []byte) bool {
+	return len(b) > tarMagicOffset+5 && bytes.Equal(b[tarMagicOffset:tarMagicOffset+5], []byte("ustar"))
+}
+
+// newGzipReader handles both a compressed tar archive and a single
+// compressed file, the latter being named after the archive without the
+// .gz extension
+func newGzipReader(name string, r io.ReaderAt, size int64) (*streamReader, error) {
+	open := func() (*bufio.Reader, error) {
+		reader, err := gzip.NewReader(io.NewSectionReader(r, 0, size))
+		if err != nil {
+			return nil, err
+		}
+		return bufio.NewReaderSize(reader, tarMagicOffset+512), nil
+	}
+
+	reader, err := open()
+	if err != nil {
+		return nil, err
+	}
+
+	// Short reads just mean it can't be a tar archive
+	b, _ := reader.Peek(tarMagicOffset + 8)
+	if isTar(b) {
+		return newStreamReader(".tar.gz", func() (streamIterator, error) {
+			reader, err := open()
+			if err != nil {
+				return nil, err
+			}
+			return tarIterator{tar.NewReader(reader)}, nil
+		}), nil
+	}
+
+	base := filepath.Base(name)
+	if ext := filepath.Ext(base); strings.EqualFold(ext, ".gz") {
+		base = strings.TrimSuffix(base, ext)
+	}
+
+	return newStreamReader(".gz", func() (streamIterator, error) {
+		reader, err := gzip.NewReader(io.NewSectionReader(r, 0, size))
+		if err != nil {
+			return nil, err
+		}
+		return &gzipIterator{Reader: reader, name: base}, nil
+	}), nil
+}
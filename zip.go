@@ -9,51 +9,234 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync"
 
 	"github.com/uwedeportivo/torrentzip"
 )
 
+// zipFormat is the flavour of deterministic zip archive that is written
+type zipFormat int
+
+const (
+	torrentZip zipFormat = iota
+	rvzstdZip
+)
+
+// zipWriter is satisfied by both torrentzip and RVZSTD writers
+type zipWriter interface {
+	Create(string) (io.Writer, error)
+	Close() error
+}
+
+func newZipWriter(format zipFormat, w io.Writer) (zipWriter, error) {
+	switch format {
+	case rvzstdZip:
+		return newRVZSTDWriter(w)
+	default:
+		return torrentzip.NewWriter(w)
+	}
+}
+
 func zipCRC(f *zip.File) string {
 	return fmt.Sprintf("%.*x", crc32.Size<<1, f.CRC32)
 }
 
-func fileExistsInZip(path, name string) (bool, string, uint64, error) {
-	reader, err := zip.OpenReader(path)
+type zipSource struct {
+	file    string         // Loose file or source archive of any format
+	path    memberPath     // Member within the source archive, if any
+	payload *headerPayload // Data after any copier header, if stripping it
+	crc     string
+	size    uint64
+}
+
+func (s zipSource) open() (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	var err error
+	if len(s.path) == 0 {
+		rc, err = os.Open(s.file)
+	} else {
+		rc, err = openArchiveFile(s.file, s.path)
+	}
 	if err != nil {
-		return false, "", 0, err
+		return nil, err
 	}
 
-	for _, f := range reader.File {
-		if f.Name == name {
-			return true, zipCRC(f), f.UncompressedSize64, nil
+	return s.payload.wrap(rc)
+}
+
+// zipPlan collects the members each destination archive should contain so
+// that each archive is only written once
+type zipPlan struct {
+	mutex sync.Mutex
+	zips  map[string]map[string]zipSource
+}
+
+func (p *zipPlan) reset() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.zips = make(map[string]map[string]zipSource)
+}
+
+func (p *zipPlan) add(path, name string, source zipSource) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	members, ok := p.zips[path]
+	if !ok {
+		members = make(map[string]zipSource)
+		p.zips[path] = members
+	}
+
+	// The first source found wins, they should all be identical anyway
+	if _, ok := members[name]; !ok {
+		members[name] = source
+	}
+}
+
+func (p *zipPlan) paths() []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	paths := make([]string, 0, len(p.zips))
+	for path := range p.zips {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	return paths
+}
+
+func (p *zipPlan) members(path string) map[string]zipSource {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.zips[path]
+}
+
+func copyZipMember(w zipWriter, name string, fr io.Reader) error {
+	fw, err := w.Create(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(fw, fr)
+	return err
+}
+
+// copyStreamMembers copies the members to replace that come from the top
+// level of a sequential archive, reading each archive only once rather than
+// from the start again for every member. It returns the members copied
+func copyStreamMembers(w zipWriter, members map[string]zipSource, replace map[string]bool) (map[string]bool, error) {
+	sources := make(map[string]map[string]string)
+	for name := range replace {
+		source := members[name]
+		if len(source.path) != 1 {
+			continue
+		}
+
+		if sources[source.file] == nil {
+			sources[source.file] = make(map[string]string)
+		}
+
+		// Any other copies of the same member are opened individually
+		if _, ok := sources[source.file][source.path[0]]; !ok {
+			sources[source.file][source.path[0]] = name
+		}
+	}
+
+	copied := make(map[string]bool)
+	for file, wanted := range sources {
+		if err := copyStreamArchive(w, file, members, wanted, copied); err != nil {
+			return nil, err
 		}
 	}
 
-	return false, "", 0, nil
+	return copied, nil
 }
 
-func createOrUpdateZip(path, name string, fr io.Reader) error {
-	tmpfile, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+func copyStreamArchive(w zipWriter, file string, members map[string]zipSource, wanted map[string]string, copied map[string]bool) error {
+	reader, f, _, err := readArchive(file)
 	if err != nil {
 		return err
 	}
-	defer os.Remove(tmpfile.Name())
+	defer f.Close()
+
+	s, ok := reader.(*streamReader)
+	if !ok {
+		return nil
+	}
 
-	w, err := torrentzip.NewWriter(tmpfile)
+	it, err := s.open()
 	if err != nil {
 		return err
 	}
 
-	reader, err := zip.OpenReader(path)
-	if err != nil && !os.IsNotExist(err) {
+	for len(wanted) > 0 {
+		member, err := it.next()
+		if err != nil {
+			if err == io.EOF {
+				// Anything left is reported when opened individually
+				return nil
+			}
+			return err
+		}
+
+		name, ok := wanted[member]
+		if !ok {
+			continue
+		}
+		delete(wanted, member)
+
+		fr, err := members[name].payload.wrap(ioutil.NopCloser(it))
+		if err != nil {
+			return err
+		}
+
+		if err := copyZipMember(w, name, fr); err != nil {
+			fr.Close()
+			return err
+		}
+
+		fr.Close()
+
+		copied[name] = true
+	}
+
+	return nil
+}
+
+func buildZip(path string, format zipFormat, reader *zip.ReadCloser, members map[string]zipSource, replace map[string]bool) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.FileMode(0777)); err != nil {
 		return err
 	}
 
-	if err == nil {
-		defer reader.Close()
+	tmpfile, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpfile.Name())
+	defer tmpfile.Close()
+
+	w, err := newZipWriter(format, tmpfile)
+	if err != nil {
+		return err
+	}
+
+	// Closing the writer releases anything it holds, such as the
+	// temporary files for RVZSTD members, even if the archive is abandoned
+	closed := false
+	defer func() {
+		if !closed {
+			w.Close()
+		}
+	}()
 
+	// Keep any existing members that aren't being replaced
+	if reader != nil {
 		for _, f := range reader.File {
-			if name == f.Name {
+			if replace[f.Name] {
 				continue
 			}
 
@@ -62,32 +245,39 @@ func createOrUpdateZip(path, name string, fr io.Reader) error {
 				return err
 			}
 
-			fw, err := w.Create(f.Name)
-			if err != nil {
-				return err
-			}
-
-			_, err = io.Copy(fw, fr)
-			if err != nil {
+			if err := copyZipMember(w, f.Name, fr); err != nil {
+				fr.Close()
 				return err
 			}
 
 			fr.Close()
 		}
-
-		reader.Close()
 	}
 
-	fw, err := w.Create(name)
+	streamed, err := copyStreamMembers(w, members, replace)
 	if err != nil {
 		return err
 	}
 
-	_, err = io.Copy(fw, fr)
-	if err != nil {
-		return err
+	for name := range replace {
+		if streamed[name] {
+			continue
+		}
+
+		fr, err := members[name].open()
+		if err != nil {
+			return err
+		}
+
+		if err := copyZipMember(w, name, fr); err != nil {
+			fr.Close()
+			return err
+		}
+
+		fr.Close()
 	}
 
+	closed = true
 	if err := w.Close(); err != nil {
 		return err
 	}
@@ -96,27 +286,36 @@ func createOrUpdateZip(path, name string, fr io.Reader) error {
 		return err
 	}
 
-	if err := os.Rename(tmpfile.Name(), path); err != nil {
-		return err
-	}
-
-	return nil
+	return os.Rename(tmpfile.Name(), path)
 }
 
-func recreateZip(path string) (string, string, error) {
+func recreateZip(path string, format zipFormat) (_ string, _ string, err error) {
 	tmpfile, err := ioutil.TempFile(os.TempDir(), filepath.Base(path))
 	if err != nil {
 		return "", "", err
 	}
+	defer func() {
+		if err != nil {
+			tmpfile.Close()
+			os.Remove(tmpfile.Name())
+		}
+	}()
 
 	h := sha1.New()
 
 	// Create new zip and compute SHA1 at the same time
-	w, err := torrentzip.NewWriter(io.MultiWriter(tmpfile, h))
+	w, err := newZipWriter(format, io.MultiWriter(tmpfile, h))
 	if err != nil {
 		return "", "", err
 	}
 
+	closed := false
+	defer func() {
+		if !closed {
+			w.Close()
+		}
+	}()
+
 	reader, err := zip.OpenReader(path)
 	if err != nil {
 		return "", "", err
@@ -129,19 +328,15 @@ func recreateZip(path string) (string, string, error) {
 			return "", "", err
 		}
 
-		fw, err := w.Create(f.Name)
-		if err != nil {
-			return "", "", err
-		}
-
-		_, err = io.Copy(fw, fr)
-		if err != nil {
+		if err := copyZipMember(w, f.Name, fr); err != nil {
+			fr.Close()
 			return "", "", err
 		}
 
 		fr.Close()
 	}
 
+	closed = true
 	if err := w.Close(); err != nil {
 		return "", "", err
 	}
@@ -0,0 +1,167 @@
+package rombo
+
+import (
+	"archive/zip"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func zipMembers(t *testing.T, file string) []string {
+	t.Helper()
+
+	reader, err := zip.OpenReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	names := make([]string, 0, len(reader.File))
+	for _, f := range reader.File {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func TestBuildZipError(t *testing.T) {
+	tests := []struct {
+		name   string
+		format zipFormat
+	}{
+		{"torrentzip", torrentZip},
+		{"rvzstd", rvzstdZip},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, tmp := t.TempDir(), t.TempDir()
+			t.Setenv("TMPDIR", tmp)
+
+			// A directory can be opened but not read, so the
+			// member is created before the copy fails
+			members := map[string]zipSource{
+				"a.rom": {file: tmp},
+			}
+
+			if err := buildZip(filepath.Join(dir, "a.zip"), tt.format, nil, members, map[string]bool{"a.rom": true}); err == nil {
+				t.Fatal("expected an error")
+			}
+
+			for _, d := range []string{dir, tmp} {
+				files, err := ioutil.ReadDir(d)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(files) != 0 {
+					t.Errorf("%d files left behind in %s", len(files), d)
+				}
+			}
+		})
+	}
+}
+
+func TestExportSharedZip(t *testing.T) {
+	tests := []struct {
+		name   string
+		layout Layout
+	}{
+		{"torrentzip", nil},
+		{"rvzstd", SimpleZstd{}},
+	}
+
+	roms := map[string][]byte{
+		"a.rom": []byte("parent"),
+		"b.rom": []byte("clone"),
+		"c.rom": []byte("other clone"),
+	}
+
+	src := t.TempDir()
+	for name, b := range roms {
+		if err := ioutil.WriteFile(filepath.Join(src, name), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rom := func(name string) string {
+		return fmt.Sprintf(`<rom name="%s" size="%d" crc="%08x"/>`, name, len(roms[name]), crc32.ChecksumIEEE(roms[name]))
+	}
+
+	dat := fmt.Sprintf(`<datafile>
+	<game name="parent"><description>Parent</description>%s</game>
+	<game name="clone" cloneof="parent" romof="parent"><description>Clone</description>%s</game>
+	<game name="other" cloneof="parent" romof="parent"><description>Other</description>%s</game>
+</datafile>`, rom("a.rom"), rom("b.rom"), rom("c.rom"))
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := NewDatafile([]byte(dat))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dst := t.TempDir()
+
+			// Every game is exported at the same time into one
+			// merged set
+			r, err := New(d, log.New(ioutil.Discard, "", 0), true, tt.layout, WithSetMode(Merged))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := r.Export(dst, []string{src}); err != nil {
+				t.Fatal(err)
+			}
+
+			if got, want := zipMembers(t, filepath.Join(dst, "parent.zip")), []string{"a.rom", "b.rom", "c.rom"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+
+			if games, _ := d.GamesRemaining(); games != 0 {
+				t.Errorf("got %d games remaining", games)
+			}
+		})
+	}
+}
+
+func TestPathLocks(t *testing.T) {
+	var locks pathLocks
+	var wg sync.WaitGroup
+
+	held := make(map[string]int)
+	var mutex sync.Mutex
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(path string) {
+			defer wg.Done()
+
+			unlock := locks.lock(path)
+			defer unlock()
+
+			mutex.Lock()
+			held[path]++
+			if held[path] > 1 {
+				t.Errorf("%s held %d times", path, held[path])
+			}
+			mutex.Unlock()
+
+			mutex.Lock()
+			held[path]--
+			mutex.Unlock()
+		}(fmt.Sprint(i % 3))
+	}
+
+	wg.Wait()
+
+	if len(locks.locks) != 0 {
+		t.Errorf("%d locks left behind", len(locks.locks))
+	}
+}